@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	alertReservoirLow   = "reservoir-low"
+	alertReservoirEmpty = "reservoir-empty"
+)
+
+// An alert is a condition which needs attention, it stays active until the
+// condition is cleared.
+type alert struct {
+	Kind    string    `json:"kind"`
+	Plant   int       `json:"plant"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"msg"`
+}
+
+func (a *alert) topic(base string) string {
+	return fmt.Sprintf("%s/%s/%s", base, a.Kind, plantLabel(a.Plant))
+}
+
+// raiseAlert activates the alert of the plant unless it is active already
+// and reports whether it was raised. Alerts are logged and published
+// retained on the alert topic.
+func (s *station) raiseAlert(kind string, index int, format string, args ...interface{}) bool {
+	c := s.serverConfig()
+	a := alert{
+		Kind:    kind,
+		Plant:   index,
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	s.mutex.Lock()
+	for _, e := range s.Alerts {
+		if e.Kind == kind && e.Plant == index {
+			s.mutex.Unlock()
+			return false
+		}
+	}
+	s.Alerts = append(s.Alerts, a)
+	s.mutex.Unlock()
+
+	plantLogger("alerts", index).Warn(a.Message, "alert", kind)
+
+	if c.MQTT.AlertTopic != "" {
+		if b, err := json.Marshal(a); err == nil {
+			s.publish(a.topic(c.MQTT.AlertTopic), byte(1), true, string(b))
+		}
+	}
+	return true
+}
+
+// clearAlert deactivates the alert of the plant.
+func (s *station) clearAlert(kind string, index int) {
+	c := s.serverConfig()
+	s.mutex.Lock()
+	var cleared *alert
+	alerts := s.Alerts[:0]
+	for i := range s.Alerts {
+		if s.Alerts[i].Kind == kind && s.Alerts[i].Plant == index {
+			a := s.Alerts[i]
+			cleared = &a
+			continue
+		}
+		alerts = append(alerts, s.Alerts[i])
+	}
+	s.Alerts = alerts
+	s.mutex.Unlock()
+
+	if cleared == nil {
+		return
+	}
+
+	plantLogger("alerts", index).Info("alert cleared", "alert", kind)
+
+	// an empty retained message removes the alert from the broker
+	if c.MQTT.AlertTopic != "" {
+		s.publish(cleared.topic(c.MQTT.AlertTopic), byte(1), true, "")
+	}
+}
+
+func alertsHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.RLock()
+		alerts := append(make([]alert, 0, len(s.Alerts)), s.Alerts...)
+		s.mutex.RUnlock()
+
+		js, err := json.Marshal(alerts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
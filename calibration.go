@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+type calibrationPoint struct {
+	Raw   int     `json:"raw"`
+	Grams float64 `json:"g"`
+}
+
+// A scaleCalibration converts raw counts of a weight sensor to grams with
+// grams = (raw - Offset) / Scale. A zero Scale means the sensor is not
+// calibrated and raw counts are used unchanged.
+type scaleCalibration struct {
+	// Offset is the raw value of the empty scale.
+	Offset float64 `json:"offset"`
+	// Scale is the number of counts per gram.
+	Scale float64 `json:"scale"`
+	// Points are the measurements the calibration was fitted to.
+	Points []calibrationPoint `json:"points,omitempty"`
+}
+
+func (c *scaleCalibration) calibrated() bool {
+	return c.Scale != 0
+}
+
+func (c *scaleCalibration) grams(raw int) int {
+	if !c.calibrated() {
+		return raw
+	}
+	return int(math.Round((float64(raw) - c.Offset) / c.Scale))
+}
+
+func (c *scaleCalibration) raw(grams int) int {
+	if !c.calibrated() {
+		return grams
+	}
+	return int(math.Round(float64(grams)*c.Scale + c.Offset))
+}
+
+// countsPerUnit returns the number of raw counts per unit of weight.
+func (c *scaleCalibration) countsPerUnit() float64 {
+	if !c.calibrated() {
+		return 1
+	}
+	return c.Scale
+}
+
+// fitCalibration fits a line through the calibration points by least squares.
+func fitCalibration(points []calibrationPoint) (scaleCalibration, error) {
+	n := float64(len(points))
+	if n < 2 {
+		return scaleCalibration{}, fmt.Errorf("at least two points needed, got %v", len(points))
+	}
+
+	var sg, sr, sgg, sgr float64
+	for _, p := range points {
+		r := float64(p.Raw)
+		sg += p.Grams
+		sr += r
+		sgg += p.Grams * p.Grams
+		sgr += p.Grams * r
+	}
+
+	d := n*sgg - sg*sg
+	if d == 0 {
+		return scaleCalibration{}, fmt.Errorf("calibration needs different weights")
+	}
+
+	scale := (n*sgr - sg*sr) / d
+	if scale == 0 {
+		return scaleCalibration{}, fmt.Errorf("raw value does not change with weight")
+	}
+
+	return scaleCalibration{
+		Offset: (sr - scale*sg) / n,
+		Scale:  scale,
+		Points: points,
+	}, nil
+}
+
+// readRawWeight reads the raw counts of the plant's weight sensor.
+func (s *station) readRawWeight(index int) (int, error) {
+	var w [2]int
+	var err error
+	w[0], w[1], err = s.wuc.ReadWeights()
+	return w[index], err
+}
+
+// readWeights reads both weight sensors and converts the values to grams.
+func (s *station) readWeights() (w [2]int, err error) {
+	w[0], w[1], err = s.wuc.ReadWeights()
+	if err != nil {
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for i := range w {
+		w[i] = s.Calibration[i].grams(w[i])
+	}
+	return
+}
+
+// applyCalibration replaces the calibration of the plant and converts the
+// stored weights, levels, window targets, gain and watering time data to
+// the new calibration.
+func (s *station) applyCalibration(index int, c scaleCalibration) error {
+	s.mutex.Lock()
+
+	old := s.Calibration[index]
+	convert := func(v int) int {
+		return c.grams(old.raw(v))
+	}
+
+	for i, v := range s.Data.Weight[index] {
+		s.Data.Weight[index][i] = convert(v)
+	}
+	for i, v := range s.MinData.Weight[index] {
+		s.MinData.Weight[index][i] = convert(v)
+	}
+
+	s.Config[index] = convertConfig(s.Config[index], old, c)
+
+	// watering time scale is in ms per unit of weight
+	k := c.countsPerUnit() / old.countsPerUnit()
+	s.WateringTimeData[index].Scale = int(math.Round(float64(s.WateringTimeData[index].Scale) * k))
+	s.WateringTimeData[index].Fit = nil
+
+	for i := range s.Data.Events {
+		e := &s.Data.Events[i]
+		if e.Plant == index {
+			e.Delta = int(math.Round(float64(e.Delta) / k))
+		}
+	}
+
+	s.Calibration[index] = c
+	s.addConfigVersion("calibration", fmt.Sprintf("levels of plant %v converted", index+1))
+	s.mutex.Unlock()
+
+	if err := s.writePlantConfig(); err != nil {
+		return err
+	}
+	s.saveConfigHistory()
+	s.saveCalibration()
+	s.saveData()
+	s.saveWateringTime()
+	return nil
+}
+
+// convertConfig converts the levels, window targets and gain of a plant
+// configuration from one calibration to another.
+func convertConfig(c plantConfig, from, to scaleCalibration) plantConfig {
+	convert := func(v int) int {
+		return to.grams(from.raw(v))
+	}
+
+	c.LevelRange = abs(convert(c.HighLevel+c.LevelRange) - convert(c.HighLevel))
+	c.LowLevel = convert(c.LowLevel)
+	c.HighLevel = convert(c.HighLevel)
+
+	c = c.clone()
+	for i := range c.Windows {
+		if c.Windows[i].Target > 0 {
+			c.Windows[i].Target = convert(c.Windows[i].Target)
+		}
+	}
+
+	// gain is in ms per unit of weight
+	c.Gain *= to.countsPerUnit() / from.countsPerUnit()
+	return c
+}
+
+// units returns the calibration without its points.
+func (c *scaleCalibration) units() scaleCalibration {
+	return scaleCalibration{Offset: c.Offset, Scale: c.Scale}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func (s *station) readCalibration() {
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.Calibration)
+	if err != nil && os.IsNotExist(err) {
+		logger("storage").Info("no calibration found, using raw values",
+			"file", c.Files.Calibration)
+		return
+	} else if err != nil {
+		log.Fatalf("failed to read calibration from %s: %v",
+			c.Files.Calibration, err)
+	}
+
+	err = json.Unmarshal(b, &s.Calibration)
+	if err != nil {
+		log.Fatalf("failed to parse calibration: %v", err)
+	}
+}
+
+func (s *station) saveCalibration() {
+	c := s.serverConfig()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.Calibration)
+	if err != nil {
+		log.Fatalf("failed to marshal calibration: %v", err)
+	}
+
+	err = ioutil.WriteFile(c.Files.Calibration, b, 0600)
+	if err != nil {
+		log.Fatalf("failed to save calibration to %s: %v",
+			c.Files.Calibration, err)
+	}
+}
+
+// calibrationSession collects the points of a calibration in progress.
+type calibrationSession struct {
+	Points []calibrationPoint `json:"points"`
+}
+
+type calibrationStatus struct {
+	Calibration scaleCalibration    `json:"calibration"`
+	Session     *calibrationSession `json:"session,omitempty"`
+}
+
+// calibrationHandler guides through the calibration of a scale:
+//
+//	POST step=tare         reads the empty pot as zero point
+//	POST step=weight&g=500 reads the scale loaded with a known weight
+//	POST step=confirm      fits and stores the calibration
+//	POST step=cancel       discards the calibration in progress
+//
+// More than one known weight may be added for a multi-point fit.
+func calibrationHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		index := getRequestIndex(r)
+		l := plantLogger("calibration", index)
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			step := r.URL.Query().Get("step")
+			switch step {
+			case "tare":
+				raw, err := s.readRawWeight(index)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				s.mutex.Lock()
+				s.calibrationSessions[index] = &calibrationSession{
+					Points: []calibrationPoint{{Raw: raw}},
+				}
+				s.mutex.Unlock()
+				l.Info("tare", "raw", raw)
+
+			case "weight":
+				g, err := strconv.ParseFloat(r.URL.Query().Get("g"), 64)
+				if err != nil || g <= 0 {
+					http.Error(w, "invalid weight in parameter g", http.StatusBadRequest)
+					return
+				}
+				raw, err := s.readRawWeight(index)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				s.mutex.Lock()
+				session := s.calibrationSessions[index]
+				if session != nil {
+					session.Points = append(session.Points, calibrationPoint{Raw: raw, Grams: g})
+				}
+				s.mutex.Unlock()
+				if session == nil {
+					http.Error(w, "no calibration in progress, start with step=tare", http.StatusConflict)
+					return
+				}
+				l.Info("calibration point", "raw", raw, "g", g)
+
+			case "confirm":
+				s.mutex.RLock()
+				session := s.calibrationSessions[index]
+				var points []calibrationPoint
+				if session != nil {
+					points = append(points, session.Points...)
+				}
+				s.mutex.RUnlock()
+				if session == nil {
+					http.Error(w, "no calibration in progress", http.StatusConflict)
+					return
+				}
+				c, err := fitCalibration(points)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if err = s.applyCalibration(index, c); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				s.mutex.Lock()
+				s.calibrationSessions[index] = nil
+				s.mutex.Unlock()
+				l.Info("calibrated", "offset", c.Offset, "scale", c.Scale)
+
+			case "cancel":
+				s.mutex.Lock()
+				s.calibrationSessions[index] = nil
+				s.mutex.Unlock()
+
+			default:
+				http.Error(w, "invalid step: "+step, http.StatusBadRequest)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.mutex.RLock()
+		status := calibrationStatus{
+			Calibration: s.Calibration[index],
+			Session:     s.calibrationSessions[index],
+		}
+		s.mutex.RUnlock()
+
+		js, err := json.Marshal(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
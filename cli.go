@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// apiTimeout is the time the station takes at most to answer, the
+	// longest watering included
+	apiTimeout = time.Duration(maxWateringTime)*time.Millisecond + 30*time.Second
+	// runningTimeout is the time a running station takes at most to answer
+	// whether it runs
+	runningTimeout = 3 * time.Second
+)
+
+const usage = `usage: plantstation [command] [flags] [args]
+
+commands:
+  serve                       run the station (default)
+  water <plant> <ms>          water plant 1 or 2 for ms milliseconds
+  weights                     show the current weights
+  limit <plant>               show the watering limit of the WUC
+  config get <plant>          show the plant config
+  config set <plant> <file>   replace the plant config by a JSON file, - for stdin
+  config set <plant> k=v...   change fields of the plant config, v is JSON
+  calibrate <plant> [step]    show the calibration or run step tare,
+                              weight <g>, confirm or cancel
+  replay <plant> [file]       replay the history with the current or the
+                              given plant config
+  export [file]               write the data files as one JSON document
+  import [file]               restore the data files from an export
+  hash-password               hash a password read from stdin for Login.Pass
+  dashboard                   show the station live in the terminal
+
+Run "plantstation <command> -h" for the flags of a command. The commands
+calling the API of the station take the password from $PLANTSTATION_PASSWORD
+or prompt for it.
+`
+
+// runCommand runs the subcommand given by the arguments, serve if there is
+// none.
+func runCommand(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serve(args)
+		return
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "water":
+		waterCommand(args)
+	case "weights":
+		weightsCommand(args)
+	case "limit":
+		limitCommand(args)
+	case "config":
+		configCommand(args)
+	case "calibrate":
+		calibrateCommand(args)
+	case "replay":
+		replayCommand(args)
+	case "export":
+		exportCommand(args)
+	case "import":
+		importCommand(args)
+	case "hash-password":
+		hashPasswordCommand(args)
+	case "dashboard":
+		dashboardCommand(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// An apiClient calls the API of a running station.
+type apiClient struct {
+	base   string
+	user   string
+	pass   string
+	client *http.Client
+}
+
+// apiFlags are the flags selecting the station and the login. The password
+// is not taken as flag to keep it out of the process list.
+type apiFlags struct {
+	config   configFileFlag
+	url      string
+	user     string
+	insecure bool
+}
+
+func (f *apiFlags) register(fs *flag.FlagSet) {
+	f.config = newConfigFileFlag()
+	fs.Var(&f.config, "c", "server config `file` for the defaults of the other flags")
+	fs.StringVar(&f.url, "url", "", "`URL` of the station, by default the local HTTPS address")
+	fs.StringVar(&f.user, "user", "", "login user, by default Login.User")
+	fs.BoolVar(&f.insecure, "insecure", false, "do not verify the certificate of the station")
+}
+
+// client returns the API client, completing the flags from the server
+// config if it can be read. A server config given by flag must be readable.
+func (f *apiFlags) client() *apiClient {
+	// the defaults serve without a readable server config
+	sc, err := f.config.load(nil)
+	if err != nil && f.config.given {
+		log.Fatalf("failed to read server config: %v", err)
+	}
+	c := f.clientFor(sc)
+	c.askPassword()
+	return c
+}
+
+// clientFor returns the API client, completing the flags from the server
+// config.
+func (f *apiFlags) clientFor(sc serverConfig) *apiClient {
+	c := &apiClient{base: f.url, user: f.user, pass: os.Getenv("PLANTSTATION_PASSWORD")}
+	if c.base == "" {
+		host, port, _ := net.SplitHostPort(sc.HTTPS.Addr)
+		if host == "" {
+			host = "localhost"
+		}
+		c.base = "https://" + net.JoinHostPort(host, port)
+	}
+	if c.user == "" {
+		c.user = sc.Login.User
+	}
+
+	c.client = &http.Client{
+		Timeout: apiTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: f.insecure},
+		},
+	}
+	return c
+}
+
+// localClient returns the API client for the station of the server config,
+// trusting its certificate.
+func localClient(sc serverConfig) *apiClient {
+	c := (&apiFlags{}).clientFor(sc)
+	if pem, err := ioutil.ReadFile(sc.HTTPS.Cert); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		c.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+	}
+	c.askPassword()
+	return c
+}
+
+// askPassword prompts for the password if none is given and stdin is a
+// terminal.
+func (c *apiClient) askPassword() {
+	if c.pass != "" || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return
+	}
+	pass, err := readPassword(fmt.Sprintf("password of %s: ", c.user))
+	if err != nil {
+		log.Fatalf("failed to read password: %v", err)
+	}
+	c.pass = pass
+}
+
+// stationRunning reports whether a station answers on the HTTPS address of
+// the server config.
+func stationRunning(sc serverConfig) bool {
+	c := (&apiFlags{insecure: true}).clientFor(sc)
+	c.client.Timeout = runningTimeout
+	resp, err := c.client.Get(strings.TrimRight(c.base, "/") + "/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// call sends a request to the station and returns the response body. Errors
+// of the station are returned as error, field errors one per line.
+func (c *apiClient) call(method, path string, query url.Values, body io.Reader) ([]byte, error) {
+	u := strings.TrimRight(c.base, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.user, c.pass)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		var v validationResponse
+		if resp.StatusCode == http.StatusBadRequest && json.Unmarshal(b, &v) == nil && len(v.Errors) > 0 {
+			lines := make([]string, len(v.Errors))
+			for i, e := range v.Errors {
+				lines[i] = strings.TrimPrefix(e.Field+": "+e.Message, ": ")
+			}
+			return nil, fmt.Errorf("%s\n%s", resp.Status, strings.Join(lines, "\n"))
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// parsePlant returns the index of plant 1 or 2.
+func parsePlant(arg string) int {
+	p, err := strconv.Atoi(arg)
+	if err != nil || p < 1 || p > 2 {
+		log.Fatalf("invalid plant %q, expected 1 or 2", arg)
+	}
+	return p - 1
+}
+
+func plantQuery(index int) url.Values {
+	return url.Values{"i": {strconv.Itoa(index)}}
+}
+
+// parseAPIFlags parses the flags of a command calling the API and checks
+// the number of arguments, unlimited if max is negative.
+func parseAPIFlags(name, args string, argv []string, min, max int) (*apiClient, []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: plantstation %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	var f apiFlags
+	f.register(fs)
+	fs.Parse(argv)
+
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return f.client(), fs.Args()
+}
+
+func printJSON(b []byte) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		os.Stdout.Write(b)
+		return
+	}
+	out.WriteByte('\n')
+	out.WriteTo(os.Stdout)
+}
+
+func waterCommand(argv []string) {
+	c, args := parseAPIFlags("water", "<plant> <ms>", argv, 2, 2)
+	index := parsePlant(args[0])
+	if _, err := strconv.Atoi(args[1]); err != nil {
+		log.Fatalf("invalid watering time %q: %v", args[1], err)
+	}
+
+	q := plantQuery(index)
+	q.Set("t", args[1])
+	b, err := c.call(http.MethodGet, "/water", q, nil)
+	if err != nil {
+		log.Fatalf("failed to water: %v", err)
+	}
+	fmt.Printf("plant %v watered for %s ms\n", index+1, b)
+}
+
+func weightsCommand(argv []string) {
+	c, _ := parseAPIFlags("weights", "", argv, 0, 0)
+	b, err := c.call(http.MethodGet, "/weight", nil, nil)
+	if err != nil {
+		log.Fatalf("failed to read weights: %v", err)
+	}
+	fmt.Printf("%s\n", b)
+}
+
+func limitCommand(argv []string) {
+	c, args := parseAPIFlags("limit", "<plant>", argv, 1, 1)
+	b, err := c.call(http.MethodGet, "/limit", plantQuery(parsePlant(args[0])), nil)
+	if err != nil {
+		log.Fatalf("failed to read watering limit: %v", err)
+	}
+	fmt.Printf("%s\n", b)
+}
+
+// configCommand gets or sets a plant config through the API.
+func configCommand(argv []string) {
+	c, args := parseAPIFlags("config", "get <plant> | set <plant> <file> | set <plant> k=v...", argv, 2, -1)
+	index := parsePlant(args[1])
+	q := plantQuery(index)
+
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		b, err := c.call(http.MethodGet, "/config", q, nil)
+		if err != nil {
+			log.Fatalf("failed to get config: %v", err)
+		}
+		printJSON(b)
+
+	case args[0] == "set" && len(args) == 3 && !strings.Contains(args[2], "="):
+		b, err := readInput(args[2])
+		if err != nil {
+			log.Fatalf("failed to read config: %v", err)
+		}
+		b, err = c.call(http.MethodPut, "/config", q, bytes.NewReader(b))
+		if err != nil {
+			log.Fatalf("failed to set config: %v", err)
+		}
+		fmt.Printf("%s\n", b)
+
+	case args[0] == "set" && len(args) > 2:
+		// change single fields keeping the others
+		fields := map[string]interface{}{}
+		for _, kv := range args[2:] {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 {
+				log.Fatalf("expected field=value, got %q", kv)
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(p[1]), &v); err != nil {
+				v = p[1]
+			}
+			fields[p[0]] = v
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			log.Fatalf("failed to marshal config fields: %v", err)
+		}
+		b, err = c.call(http.MethodPut, "/config", q, bytes.NewReader(b))
+		if err != nil {
+			log.Fatalf("failed to set config: %v", err)
+		}
+		fmt.Printf("%s\n", b)
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func calibrateCommand(argv []string) {
+	c, args := parseAPIFlags("calibrate", "<plant> [tare | weight <g> | confirm | cancel]", argv, 1, 3)
+	q := plantQuery(parsePlant(args[0]))
+
+	method := http.MethodGet
+	if len(args) > 1 {
+		method = http.MethodPost
+		q.Set("step", args[1])
+		if args[1] == "weight" {
+			if len(args) != 3 {
+				log.Fatalf("missing weight in g")
+			}
+			q.Set("g", args[2])
+		}
+	}
+
+	b, err := c.call(method, "/calibrate", q, nil)
+	if err != nil {
+		log.Fatalf("calibration failed: %v", err)
+	}
+	printJSON(b)
+}
+
+// replayCommand shows what a plant config would have done over the stored
+// history.
+func replayCommand(argv []string) {
+	c, args := parseAPIFlags("replay", "<plant> [config file]", argv, 1, 2)
+	index := parsePlant(args[0])
+
+	var req dryRunRequest
+	if len(args) == 2 {
+		b, err := readInput(args[1])
+		if err != nil {
+			log.Fatalf("failed to read config: %v", err)
+		}
+		req.Config = &plantConfig{}
+		if err = json.Unmarshal(b, req.Config); err != nil {
+			log.Fatalf("failed to parse config: %v", err)
+		}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Fatalf("failed to marshal request: %v", err)
+	}
+	b, err := c.call(http.MethodPost, "/dryrun", plantQuery(index), bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("replay failed: %v", err)
+	}
+
+	var res dryRunResult
+	if err = json.Unmarshal(b, &res); err != nil {
+		log.Fatalf("invalid response: %v", err)
+	}
+	r := res.Replay
+	fmt.Printf("now:             due %v, %v ms (%v)\n", res.Due, res.Ms, res.Decision.Branch)
+	fmt.Printf("hours:           %v\n", r.Hours)
+	fmt.Printf("waterings:       %v\n", r.Waterings)
+	fmt.Printf("water:           %v ms, actual %v ms\n", r.Water, r.ActualWater)
+	fmt.Printf("min weight:      %v\n", r.MinWeight)
+	fmt.Printf("days below low:  %v, actual %v\n", r.DaysBelowLow, r.ActualDaysBelowLow)
+}
+
+// readInput reads the file, stdin for "-".
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// dataFiles returns the data files of the station by name.
+func dataFiles(c *serverConfig) map[string]string {
+	return map[string]string{
+		"config":      c.Files.Config,
+		"data":        c.Files.Data,
+		"watertime":   c.Files.WaterTime,
+		"calibration": c.Files.Calibration,
+		"mode":        c.Files.Mode,
+		"ledger":      c.Files.Ledger,
+		"decisions":   c.Files.Decisions,
+		"history":     c.Files.History,
+	}
+}
+
+// parseFileFlags parses the flags of a command working on the data files.
+func parseFileFlags(name, args string, argv []string) (serverConfig, []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: plantstation %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	sconfFile := newConfigFileFlag()
+	var overrides configOverrides
+	fs.Var(&sconfFile, "c", "server config `file`")
+	fs.Var(&overrides, "set", "override server config `Section.Field=value`, may be repeated")
+	fs.Parse(argv)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := sconfFile.load(overrides)
+	if err != nil {
+		log.Fatalf("failed to read server config: %v", err)
+	}
+	return c, fs.Args()
+}
+
+// exportCommand writes the data files as one JSON document with the file
+// contents by name.
+func exportCommand(argv []string) {
+	c, args := parseFileFlags("export", "[file]", argv)
+
+	export := map[string]json.RawMessage{}
+	for name, file := range dataFiles(&c) {
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Fatalf("failed to read %s: %v", file, err)
+		}
+		if !json.Valid(b) {
+			log.Fatalf("invalid JSON in %s", file)
+		}
+		export[name] = b
+	}
+
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to marshal export: %v", err)
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err = ioutil.WriteFile(args[0], b, 0600); err != nil {
+		log.Fatalf("failed to write %s: %v", args[0], err)
+	}
+}
+
+// importCommand restores the data files from an export. The station must
+// be stopped since it saves its state on exit.
+func importCommand(argv []string) {
+	c, args := parseFileFlags("import", "[file]", argv)
+	if stationRunning(c) {
+		log.Fatalf("station is running on %v, stop it before importing", c.HTTPS.Addr)
+	}
+
+	file := "-"
+	if len(args) > 0 {
+		file = args[0]
+	}
+	b, err := readInput(file)
+	if err != nil {
+		log.Fatalf("failed to read import: %v", err)
+	}
+
+	var export map[string]json.RawMessage
+	if err = json.Unmarshal(b, &export); err != nil {
+		log.Fatalf("failed to parse import: %v", err)
+	}
+
+	files := dataFiles(&c)
+	for name := range export {
+		if _, ok := files[name]; !ok {
+			log.Fatalf("unknown data file %q in import", name)
+		}
+	}
+	if config, ok := export["config"]; ok {
+		var pc [2]plantConfig
+		if err = json.Unmarshal(config, &pc); err != nil {
+			log.Fatalf("failed to parse plant config: %v", err)
+		}
+		if err = validatePlantConfigs(&pc, c.Location); err != nil {
+			log.Fatalf("invalid plant config: %v", err)
+		}
+	}
+
+	for name, content := range export {
+		if err = ioutil.WriteFile(files[name], content, 0600); err != nil {
+			log.Fatalf("failed to write %s: %v", files[name], err)
+		}
+		fmt.Printf("%v restored to %v\n", name, files[name])
+	}
+}
+
+// readPassword reads a password from stdin, prompting for it without echo
+// if stdin is a terminal.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(pass, "\r\n"), nil
+}
+
+// hashPasswordCommand hashes the password read from stdin with bcrypt for
+// Login.Pass.
+func hashPasswordCommand(argv []string) {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	cost := fs.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	fs.Parse(argv)
+
+	pass, err := readPassword("password: ")
+	if err != nil {
+		log.Fatalf("failed to read password: %v", err)
+	}
+	if pass == "" {
+		log.Fatalf("empty password")
+	}
+
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), *cost)
+	if err != nil {
+		log.Fatalf("failed to hash password: %v", err)
+	}
+	// go-http-auth recognizes bcrypt by the prefix, $2y$ is the fixed
+	// variant
+	fmt.Println("$2y$" + strings.TrimPrefix(string(h), "$2a$"))
+}
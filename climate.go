@@ -0,0 +1,57 @@
+package main
+
+import "math"
+
+// climate factors are limited to this range around 1
+const (
+	minClimateFactor = 0.5
+	maxClimateFactor = 2.0
+)
+
+// vpd returns the vapour pressure deficit in kPa for temperature and
+// relative humidity given in hundredths of °C and %.
+func vpd(temperature, humidity int) float64 {
+	t := float64(temperature) / 100
+	rh := float64(humidity) / 100
+	// saturation vapour pressure by Tetens' formula
+	svp := 0.6108 * math.Exp(17.27*t/(t+237.3))
+	return svp * (1 - rh/100)
+}
+
+// meanVPD returns the mean vapour pressure deficit of the hourly samples
+// in [from, to).
+func (d *measurementData) meanVPD(from, to int) float64 {
+	sum := 0.0
+	for i := from; i < to; i++ {
+		sum += vpd(d.Temperature[i], d.Humidity[i])
+	}
+	return sum / float64(to-from)
+}
+
+// climateFactor estimates how much the dryout of the next 24 hours differs
+// from the average dryout of the stored history. The climate of the last 24
+// hours serves as forecast and evaporation is assumed to be proportional to
+// the vapour pressure deficit. The caller must hold the mutex.
+func (s *station) climateFactor() float64 {
+	n := len(s.Data.Temperature)
+	if len(s.Data.Humidity) < n {
+		n = len(s.Data.Humidity)
+	}
+
+	// need at least one day besides the forecast
+	if n < 48 {
+		return 1
+	}
+
+	t := s.Data.Temperature[len(s.Data.Temperature)-n:]
+	h := s.Data.Humidity[len(s.Data.Humidity)-n:]
+	d := measurementData{Temperature: t, Humidity: h}
+
+	history := d.meanVPD(0, n)
+	if history <= 0 {
+		return 1
+	}
+
+	f := d.meanVPD(n-24, n) / history
+	return math.Max(minClimateFactor, math.Min(maxClimateFactor, f))
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// errUnknownUnits is returned for a rollback to a version of unknown
+// calibration while the scales are calibrated.
+var errUnknownUnits = errors.New("config version has no calibration, weights may be raw counts")
+
+// A configVersion is a saved plant configuration of both plants.
+type configVersion struct {
+	Version int            `json:"version"`
+	Time    time.Time      `json:"time"`
+	Author  string         `json:"author"`
+	Comment string         `json:"comment,omitempty"`
+	Config  [2]plantConfig `json:"config"`
+	// Calibration gives the units of the weights in Config, nil for
+	// versions recorded before calibrations were kept.
+	Calibration *[2]scaleCalibration `json:"calibration,omitempty"`
+}
+
+// A configChange is a field differing between two configurations.
+type configChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// clone returns a copy of the configuration not sharing its slices, which
+// the live configuration and the config history must not share.
+func (c plantConfig) clone() plantConfig {
+	c.Schedule = append([]scheduledWatering(nil), c.Schedule...)
+	c.Windows = append([]wateringWindow(nil), c.Windows...)
+	return c
+}
+
+// addConfigVersion records the current plant configuration and calibration
+// as a new version unless they equal the last one. The caller must hold the
+// mutex.
+func (s *station) addConfigVersion(author, comment string) configVersion {
+	cal := [2]scaleCalibration{s.Calibration[0].units(), s.Calibration[1].units()}
+	if n := len(s.configHistory); n > 0 &&
+		reflect.DeepEqual(s.configHistory[n-1].Config, s.Config) &&
+		reflect.DeepEqual(s.configHistory[n-1].Calibration, &cal) {
+		return s.configHistory[n-1]
+	}
+
+	v := configVersion{
+		Version:     1,
+		Time:        time.Now(),
+		Author:      author,
+		Comment:     comment,
+		Config:      [2]plantConfig{s.Config[0].clone(), s.Config[1].clone()},
+		Calibration: &cal,
+	}
+	if n := len(s.configHistory); n > 0 {
+		v.Version = s.configHistory[n-1].Version + 1
+	}
+	s.configHistory = append(s.configHistory, v)
+	return v
+}
+
+// configVersionByNumber returns the version with the given number. The
+// caller must hold the mutex.
+func (s *station) configVersionByNumber(version int) (configVersion, bool) {
+	for _, v := range s.configHistory {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return configVersion{}, false
+}
+
+// rollbackConfig restores the plant configuration of an earlier version,
+// recorded as a new version. The weights of a version recorded with another
+// calibration are converted to the current one.
+func (s *station) rollbackConfig(version int, author string) (configVersion, error) {
+	s.mutex.Lock()
+	old, ok := s.configVersionByNumber(version)
+	if !ok {
+		s.mutex.Unlock()
+		return configVersion{}, fmt.Errorf("no config version %v", version)
+	}
+	for i := range old.Config {
+		old.Config[i] = old.Config[i].clone()
+		switch {
+		case old.Calibration != nil:
+			if reflect.DeepEqual(old.Calibration[i], s.Calibration[i].units()) {
+				continue
+			}
+			old.Config[i] = convertConfig(old.Config[i], old.Calibration[i], s.Calibration[i])
+		case s.Calibration[i].calibrated():
+			s.mutex.Unlock()
+			return configVersion{}, errUnknownUnits
+		}
+	}
+	if err := validatePlantConfigs(&old.Config, s.serverConfig().Location); err != nil {
+		s.mutex.Unlock()
+		return configVersion{}, err
+	}
+	s.Config = old.Config
+	v := s.addConfigVersion(author, fmt.Sprintf("rollback to version %v", version))
+	s.mutex.Unlock()
+
+	if err := s.writePlantConfig(); err != nil {
+		return v, err
+	}
+	s.saveConfigHistory()
+	logger("config").Info("config rolled back", "version", version, "new", v.Version, "author", author)
+	return v, nil
+}
+
+// flattenJSON maps the paths of all values of a decoded JSON document to
+// the values.
+func flattenJSON(prefix string, v interface{}, res map[string]interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			flattenJSON(p, e, res)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenJSON(fmt.Sprintf("%v[%v]", prefix, i), e, res)
+		}
+	default:
+		res[prefix] = v
+	}
+}
+
+// diffConfigs returns the fields differing between two configurations,
+// sorted by field. Fields missing in one of them are nil.
+func diffConfigs(from, to [2]plantConfig) ([]configChange, error) {
+	flatten := func(c [2]plantConfig) (map[string]interface{}, error) {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		res := map[string]interface{}{}
+		flattenJSON("", v, res)
+		return res, nil
+	}
+
+	a, err := flatten(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := flatten(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]configChange, 0)
+	for k, va := range a {
+		if vb, ok := b[k]; !ok || !reflect.DeepEqual(va, vb) {
+			changes = append(changes, configChange{Field: k, From: va, To: b[k]})
+		}
+	}
+	for k, vb := range b {
+		if _, ok := a[k]; !ok {
+			changes = append(changes, configChange{Field: k, To: vb})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// readConfigHistory reads the configuration history and records the current
+// configuration if it differs from the last version, e.g. after editing the
+// file by hand.
+func (s *station) readConfigHistory() {
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.History)
+	if err != nil && os.IsNotExist(err) {
+		logger("storage").Info("no config history found",
+			"file", c.Files.History)
+	} else if err != nil {
+		log.Fatalf("failed to read config history from %s: %v",
+			c.Files.History, err)
+	} else if err = json.Unmarshal(b, &s.configHistory); err != nil {
+		log.Fatalf("failed to parse config history: %v", err)
+	}
+
+	n := len(s.configHistory)
+	if v := s.addConfigVersion("file", c.Files.Config); len(s.configHistory) > n {
+		logger("config").Info("config version recorded", "version", v.Version)
+		s.saveConfigHistory()
+	}
+}
+
+func (s *station) saveConfigHistory() {
+	c := s.serverConfig()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.configHistory)
+	if err != nil {
+		log.Fatalf("failed to marshal config history: %v", err)
+	}
+
+	err = ioutil.WriteFile(c.Files.History, b, 0600)
+	if err != nil {
+		log.Fatalf("failed to save config history to %s: %v",
+			c.Files.History, err)
+	}
+}
+
+// requestAuthor returns the user of the request or its remote address.
+func requestAuthor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// historyHandler returns the configuration versions, newest first, or the
+// version given by parameter v.
+func historyHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		if vs := r.URL.Query().Get("v"); vs != "" {
+			n, err := strconv.Atoi(vs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			v, ok := s.configVersionByNumber(n)
+			if !ok {
+				http.Error(w, "no such config version", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, v)
+			return
+		}
+
+		res := make([]configVersion, 0, len(s.configHistory))
+		for i := len(s.configHistory) - 1; i >= 0; i-- {
+			res = append(res, s.configHistory[i])
+		}
+		writeJSON(w, res)
+	}
+}
+
+// diffHandler returns the changes from the version given by parameter from
+// to the one given by parameter to, by default the current configuration.
+func diffHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		s.mutex.RLock()
+		configs := [2][2]plantConfig{s.Config, s.Config}
+		for i, p := range []string{"from", "to"} {
+			if q.Get(p) == "" {
+				continue
+			}
+			n, err := strconv.Atoi(q.Get(p))
+			if err != nil {
+				s.mutex.RUnlock()
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			v, ok := s.configVersionByNumber(n)
+			if !ok {
+				s.mutex.RUnlock()
+				http.Error(w, fmt.Sprintf("no config version %v", n), http.StatusNotFound)
+				return
+			}
+			configs[i] = v.Config
+		}
+		s.mutex.RUnlock()
+
+		changes, err := diffConfigs(configs[0], configs[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, changes)
+	}
+}
+
+// rollbackHandler restores the configuration version given by parameter v.
+func rollbackHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		n, err := strconv.Atoi(r.URL.Query().Get("v"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		v, err := s.rollbackConfig(n, requestAuthor(r))
+		if _, ok := err.(validationErrors); ok {
+			writeValidationError(w, err)
+			return
+		} else if err == errUnknownUnits {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, v)
+	}
+}
+
+// configHistoryCommand runs the configuration history command given on the
+// command line on the stored files and reports whether there was one. A
+// rollback goes through the API of a running station, which would
+// otherwise overwrite the files.
+func (s *station) configHistoryCommand(out io.Writer, history bool, diff string, rollback int) bool {
+	switch {
+	case history:
+		for _, v := range s.configHistory {
+			fmt.Fprintf(out, "%v\t%v\t%v\t%v\n",
+				v.Version, v.Time.Format(time.RFC3339), v.Author, v.Comment)
+		}
+	case diff != "":
+		var from, to int
+		if _, err := fmt.Sscanf(diff, "%d:%d", &from, &to); err != nil {
+			log.Fatalf("invalid diff %q, expected from:to: %v", diff, err)
+		}
+		a, ok := s.configVersionByNumber(from)
+		b, ok2 := s.configVersionByNumber(to)
+		if !ok || !ok2 {
+			log.Fatalf("no config versions %v and %v", from, to)
+		}
+		changes, err := diffConfigs(a.Config, b.Config)
+		if err != nil {
+			log.Fatalf("failed to diff config versions: %v", err)
+		}
+		for _, c := range changes {
+			fmt.Fprintf(out, "%v\t%v -> %v\n", c.Field, c.From, c.To)
+		}
+	case rollback > 0 && stationRunning(*s.serverConfig()):
+		q := url.Values{"v": {strconv.Itoa(rollback)}}
+		b, err := localClient(*s.serverConfig()).call(http.MethodPost, "/rollback", q, nil)
+		if err != nil {
+			log.Fatalf("failed to roll back config of the running station: %v", err)
+		}
+		var v configVersion
+		if err = json.Unmarshal(b, &v); err != nil {
+			log.Fatalf("failed to parse config version: %v", err)
+		}
+		fmt.Fprintf(out, "restored version %v as version %v\n", rollback, v.Version)
+	case rollback > 0:
+		author := os.Getenv("USER")
+		if author == "" {
+			author = "cli"
+		}
+		v, err := s.rollbackConfig(rollback, author)
+		if err != nil {
+			log.Fatalf("failed to roll back config: %v", err)
+		}
+		fmt.Fprintf(out, "restored version %v as version %v, applies at the next start\n",
+			rollback, v.Version)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fileStation returns a station saving its files to a temporary directory.
+func fileStation(t *testing.T) *station {
+	dir := t.TempDir()
+	s := &station{}
+	s.config.Store(&serverConfig{Files: filesConfig{
+		Config:  filepath.Join(dir, "config.json"),
+		History: filepath.Join(dir, "history.json"),
+	}})
+	return s
+}
+
+func putConfig(t *testing.T, s *station, index int, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/config", strings.NewReader(body))
+	s.saveConfig(index, w, r)
+	return w
+}
+
+func TestConfigHistoryRoundTrip(t *testing.T) {
+	s := fileStation(t)
+	s.Config[0] = plantConfig{
+		MaxWater: 10000,
+		Windows:  []wateringWindow{{timing: timing{Hour: 7}}, {timing: timing{Hour: 19}}},
+	}
+	s.Config[1].MaxWater = 10000
+	s.addConfigVersion("test", "")
+
+	w := putConfig(t, s, 0, `{"windows":[{"hour":8},{"hour":20}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT = %v %v", w.Code, w.Body)
+	}
+	if n := len(s.configHistory); n != 2 {
+		t.Fatalf("%v versions, want 2", n)
+	}
+	if h := s.configHistory[0].Config[0].Windows[0].Hour; h != 7 {
+		t.Errorf("version 1 changed to hour %v by the PUT", h)
+	}
+	if h := s.configHistory[1].Config[0].Windows[0].Hour; h != 8 {
+		t.Errorf("version 2 has hour %v, want 8", h)
+	}
+
+	v, err := s.rollbackConfig(1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 3 {
+		t.Errorf("rollback recorded version %v, want 3", v.Version)
+	}
+	if h := s.Config[0].Windows[0].Hour; h != 7 {
+		t.Errorf("rolled back to hour %v, want 7", h)
+	}
+
+	s.Config[0].Windows[0].Hour = 9
+	if h := s.configHistory[0].Config[0].Windows[0].Hour; h != 7 {
+		t.Errorf("version 1 shares its windows with the config, hour %v", h)
+	}
+	if h := s.configHistory[2].Config[0].Windows[0].Hour; h != 7 {
+		t.Errorf("version 3 shares its windows with the config, hour %v", h)
+	}
+}
+
+func TestConfigHistoryUnchanged(t *testing.T) {
+	s := fileStation(t)
+	s.Config[0].MaxWater = 10000
+	s.Config[1].MaxWater = 10000
+	s.addConfigVersion("test", "")
+
+	if w := putConfig(t, s, 0, `{"max":10000}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT = %v %v", w.Code, w.Body)
+	}
+	if n := len(s.configHistory); n != 1 {
+		t.Errorf("%v versions of an unchanged config, want 1", n)
+	}
+
+	if _, err := s.rollbackConfig(5, "test"); err == nil {
+		t.Error("rollback to a missing version")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// envPrefix starts the environment variables overriding the server
+	// config as PLANTSTATION_<SECTION>_<FIELD>
+	envPrefix = "PLANTSTATION_"
+	// credentialsEnv names the directory of systemd credentials
+	credentialsEnv = "CREDENTIALS_DIRECTORY"
+	redacted       = "<redacted>"
+)
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		Login: loginConfig{
+			User: "user",
+			Pass: "",
+		},
+		HTTPS: httpsConfig{
+			Addr: ":443",
+			Cert: "localhost.crt",
+			Key:  "localhost.key",
+		},
+		Files: filesConfig{
+			Config:      "/var/opt/plantstation/plant.conf",
+			Data:        "/var/opt/plantstation/data.json",
+			WaterTime:   "/var/opt/plantstation/watertime.json",
+			MQTTQueue:   "/var/opt/plantstation/mqttqueue.json",
+			Calibration: "/var/opt/plantstation/calibration.json",
+			Decisions:   "/var/opt/plantstation/decisions.json",
+		},
+		Reservoir: reservoirConfig{
+			AlertDays: 3,
+		},
+	}
+}
+
+// loadServerConfig merges the server configuration from the defaults, the
+// TOML file, the environment, the overrides and the secret files in this
+// order. A missing TOML file counts as empty if it is optional.
+func loadServerConfig(serverConf string, optional bool, overrides []string) (serverConfig, error) {
+	c := defaultServerConfig()
+
+	b, err := ioutil.ReadFile(serverConf)
+	if err != nil && !(optional && os.IsNotExist(err)) {
+		return c, err
+	}
+
+	if err == nil {
+		if err = toml.Unmarshal(b, &c); err != nil {
+			return c, fmt.Errorf("failed to parse %s: %v", serverConf, err)
+		}
+	}
+
+	if err = c.applyEnv(); err != nil {
+		return c, err
+	}
+	if err = c.applyOverrides(overrides); err != nil {
+		return c, err
+	}
+	if err = c.applySecrets(); err != nil {
+		return c, err
+	}
+
+	if c.Files.Mode == "" {
+		c.Files.Mode = filepath.Join(filepath.Dir(c.Files.Config), "mode.json")
+	}
+	if c.Files.Ledger == "" {
+		c.Files.Ledger = filepath.Join(filepath.Dir(c.Files.Config), "ledger.json")
+	}
+	if c.Files.History == "" {
+		c.Files.History = filepath.Join(filepath.Dir(c.Files.Config), "history.json")
+	}
+
+	return c, nil
+}
+
+// A configFileFlag is the server config file given by the -c flag. The file
+// is optional unless the flag is given.
+type configFileFlag struct {
+	path  string
+	given bool
+}
+
+func newConfigFileFlag() configFileFlag {
+	return configFileFlag{path: "server.conf"}
+}
+
+func (f *configFileFlag) String() string {
+	return f.path
+}
+
+func (f *configFileFlag) Set(v string) error {
+	f.path = v
+	f.given = true
+	return nil
+}
+
+// load loads the server configuration from the file with the overrides.
+func (f *configFileFlag) load(overrides []string) (serverConfig, error) {
+	return loadServerConfig(f.path, !f.given, overrides)
+}
+
+// configOverrides are the server config fields given on the command line as
+// Section.Field=value.
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected Section.Field=value, got %q", v)
+	}
+	*o = append(*o, v)
+	return nil
+}
+
+// A secretSource reads a password from a file given in the config or from a
+// systemd credential.
+type secretSource struct {
+	pass       *string
+	file       string
+	credential string
+}
+
+// configField returns the field of a section by case insensitive names.
+func configField(c *serverConfig, section, field string) (reflect.Value, bool) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !strings.EqualFold(v.Type().Field(i).Name, section) {
+			continue
+		}
+		sv := v.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			if strings.EqualFold(sv.Type().Field(j).Name, field) {
+				return sv.Field(j), true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setConfigField parses the value into the field.
+func setConfigField(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(i))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(x)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %v", f.Type())
+	}
+	return nil
+}
+
+// applyEnv sets the fields given by environment variables.
+func (c *serverConfig) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		section := v.Type().Field(i).Name
+		sv := v.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			field := sv.Type().Field(j).Name
+			name := envPrefix + strings.ToUpper(section) + "_" + strings.ToUpper(field)
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setConfigField(sv.Field(j), value); err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyOverrides sets the fields given as Section.Field=value.
+func (c *serverConfig) applyOverrides(overrides []string) error {
+	for _, o := range overrides {
+		kv := strings.SplitN(o, "=", 2)
+		path := strings.SplitN(kv[0], ".", 2)
+		if len(kv) != 2 || len(path) != 2 {
+			return fmt.Errorf("expected Section.Field=value, got %q", o)
+		}
+		f, ok := configField(c, path[0], path[1])
+		if !ok {
+			return fmt.Errorf("unknown server config field %s", kv[0])
+		}
+		if err := setConfigField(f, kv[1]); err != nil {
+			return fmt.Errorf("invalid %s: %v", kv[0], err)
+		}
+	}
+	return nil
+}
+
+// readSecret returns the content of a secret file without the trailing
+// newline.
+func readSecret(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// applySecrets reads the passwords from their files. Without a file given,
+// the systemd credentials login-pass and mqtt-pass are used for passwords
+// not set otherwise.
+func (c *serverConfig) applySecrets() error {
+	secrets := []secretSource{
+		{&c.Login.Pass, c.Login.PassFile, "login-pass"},
+		{&c.MQTT.Pass, c.MQTT.PassFile, "mqtt-pass"},
+	}
+
+	dir := os.Getenv(credentialsEnv)
+	for _, s := range secrets {
+		file := s.file
+		if file == "" && *s.pass == "" && dir != "" {
+			file = filepath.Join(dir, s.credential)
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				continue
+			}
+		}
+		if file == "" {
+			continue
+		}
+
+		pass, err := readSecret(file)
+		if err != nil {
+			return fmt.Errorf("failed to read secret: %v", err)
+		}
+		*s.pass = pass
+	}
+	return nil
+}
+
+// redact replaces the values of the fields tagged as secret.
+func (c *serverConfig) redact() {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		sv := v.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			f := sv.Field(j)
+			if sv.Type().Field(j).Tag.Get("secret") == "true" && f.String() != "" {
+				f.SetString(redacted)
+			}
+		}
+	}
+}
+
+// printServerConfig writes the effective server config as TOML with the
+// secrets redacted.
+func printServerConfig(w io.Writer, c serverConfig) error {
+	c.redact()
+	return toml.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadServerConfigMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "server.conf")
+
+	c, err := loadServerConfig(missing, true, nil)
+	if err != nil {
+		t.Fatalf("optional file: %v", err)
+	}
+	if c.Files.History != "/var/opt/plantstation/history.json" {
+		t.Errorf("Files.History = %v, want the default next to Files.Config", c.Files.History)
+	}
+
+	if _, err := loadServerConfig(missing, false, nil); !os.IsNotExist(err) {
+		t.Errorf("required file: err = %v, want not existing", err)
+	}
+}
+
+func TestConfigFileFlag(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "server.conf")
+
+	for _, args := range [][]string{nil, {"-c", missing}} {
+		f := newConfigFileFlag()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Var(&f, "c", "server config `file`")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if f.given != (len(args) > 0) {
+			t.Errorf("%v: given = %v", args, f.given)
+		}
+		if f.given {
+			if _, err := f.load(nil); err == nil {
+				t.Errorf("%v: loaded a missing file given by flag", args)
+			}
+		} else if f.path != "server.conf" {
+			t.Errorf("%v: path = %v, want server.conf", args, f.path)
+		}
+	}
+}
+
+func TestLoadServerConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "server.conf")
+	if err := ioutil.WriteFile(file, []byte("[HTTPS]\nAddr = \":8443\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pass := filepath.Join(dir, "pass")
+	if err := ioutil.WriteFile(pass, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(envPrefix+"HTTPS_ADDR", ":9443")
+	t.Setenv(envPrefix+"LOGIN_USER", "env")
+	t.Setenv(envPrefix+"LOGIN_PASSFILE", pass)
+	c, err := loadServerConfig(file, false, []string{"login.user=flag", "Files.Config=/tmp/x/config.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.HTTPS.Addr != ":9443" {
+		t.Errorf("HTTPS.Addr = %v, want the environment over the file", c.HTTPS.Addr)
+	}
+	if c.Login.User != "flag" {
+		t.Errorf("Login.User = %v, want the override over the environment", c.Login.User)
+	}
+	if c.Login.Pass != "secret" {
+		t.Errorf("Login.Pass = %q, want the secret file without newline", c.Login.Pass)
+	}
+	if c.Files.Mode != "/tmp/x/mode.json" {
+		t.Errorf("Files.Mode = %v, want it next to Files.Config", c.Files.Mode)
+	}
+
+	if _, err := loadServerConfig(file, false, []string{"Login.Nope=1"}); err == nil {
+		t.Error("unknown override field accepted")
+	}
+	t.Setenv(envPrefix+"LOG_BUFFER", "many")
+	if _, err := loadServerConfig(file, false, nil); err == nil {
+		t.Error("invalid environment value accepted")
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/term"
+)
+
+const (
+	sparkBlocks = "▁▂▃▄▅▆▇█"
+	// dashboardLabel is the width of the labels in front of sparklines
+	dashboardLabel = 28
+)
+
+// dashboardPlant is what the dashboard shows of a plant.
+type dashboardPlant struct {
+	// Weight and Level are the minute weights and reservoir levels
+	Weight []int
+	Level  []int
+	// Reservoir is nil if unknown
+	Reservoir *reservoirState
+	// LastWatering is zero if unknown, LastMs the watering time then
+	LastWatering time.Time
+	LastMs       int
+}
+
+// dashboardState is what the dashboard shows of a station.
+type dashboardState struct {
+	Plants [2]dashboardPlant
+	// Temperature and Humidity are the minute values in hundredths
+	Temperature []int
+	Humidity    []int
+}
+
+// A dashboardSource provides the state of a station and waters its plants.
+type dashboardSource interface {
+	name() string
+	state() (dashboardState, error)
+	water(index, ms int) (string, error)
+	close()
+}
+
+// httpSource polls the data of a station through its API.
+type httpSource struct {
+	client *apiClient
+}
+
+func (h *httpSource) name() string {
+	return h.client.base
+}
+
+func (h *httpSource) state() (dashboardState, error) {
+	var st dashboardState
+
+	b, err := h.client.call(http.MethodGet, "/data", nil, nil)
+	if err != nil {
+		return st, err
+	}
+
+	var data struct {
+		Data      measurementData   `json:"data"`
+		MinData   measurementData   `json:"mindata"`
+		Reservoir [2]reservoirState `json:"reservoir"`
+		Ledger    stationLedger     `json:"ledger"`
+	}
+	if err = json.Unmarshal(b, &data); err != nil {
+		return st, err
+	}
+
+	st.Temperature = data.MinData.Temperature
+	st.Humidity = data.MinData.Humidity
+	for i := range st.Plants {
+		p := &st.Plants[i]
+		p.Weight = data.MinData.Weight[i]
+		p.Level = data.MinData.Level[i]
+		p.Reservoir = &data.Reservoir[i]
+		p.LastWatering = data.Ledger.Plants[i].Last
+		// the hourly sums hold the amount
+		w := data.Data.Watering[i]
+		for j := len(w) - 1; j >= 0; j-- {
+			if w[j] > 0 {
+				p.LastMs = w[j]
+				break
+			}
+		}
+	}
+	return st, nil
+}
+
+func (h *httpSource) water(index, ms int) (string, error) {
+	q := plantQuery(index)
+	q.Set("t", strconv.Itoa(ms))
+	b, err := h.client.call(http.MethodGet, "/water", q, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("plant %v watered for %s ms", index+1, b), nil
+}
+
+func (h *httpSource) close() {}
+
+// mqttSource collects the values a station publishes to the MQTT broker.
+// The sparklines start empty and fill while the dashboard runs.
+type mqttSource struct {
+	config mqttConfig
+	client MQTT.Client
+
+	mutex sync.Mutex
+	st    dashboardState
+}
+
+func newMQTTSource(config mqttConfig) (*mqttSource, error) {
+	m := &mqttSource{config: config}
+
+	opts := MQTT.NewClientOptions().AddBroker(config.Server)
+	opts.SetClientID(config.ClientID + "-dashboard")
+	opts.SetUsername(config.User)
+	opts.SetPassword(config.Pass)
+	opts.SetConnectTimeout(mqttTimeout)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(m.subscribe)
+	if config.CACert != "" || config.ClientCert != "" {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	m.client = MQTT.NewClient(opts)
+	token := m.client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return nil, fmt.Errorf("timeout while connecting to %v", config.Server)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// subscribe subscribes the topics of the station on every connect.
+func (m *mqttSource) subscribe(c MQTT.Client) {
+	value := func(update func(st *dashboardState, v float64)) MQTT.MessageHandler {
+		return func(c MQTT.Client, msg MQTT.Message) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+			if err != nil {
+				return
+			}
+			m.mutex.Lock()
+			update(&m.st, v)
+			m.mutex.Unlock()
+		}
+	}
+
+	for i, topic := range []string{m.config.Plant1Topic, m.config.Plant2Topic} {
+		i := i
+		c.Subscribe(topic+"/weight", 1, value(func(st *dashboardState, v float64) {
+			p := &st.Plants[i]
+			p.Weight = pushSlice(p.Weight, int(v), backlogMinutes)
+		}))
+		c.Subscribe(topic+"/water", 1, func(c MQTT.Client, msg MQTT.Message) {
+			// a retained watering happened at an unknown time
+			retained := msg.Retained()
+			value(func(st *dashboardState, v float64) {
+				if !retained {
+					st.Plants[i].LastWatering = time.Now()
+				}
+				st.Plants[i].LastMs = int(v)
+			})(c, msg)
+		})
+		c.Subscribe(topic+"/state", 1, func(c MQTT.Client, msg MQTT.Message) {
+			var ps plantState
+			if json.Unmarshal(msg.Payload(), &ps) != nil {
+				return
+			}
+			level, ok := ps.WaterLimit.Value.(float64)
+			if !ok {
+				return
+			}
+			m.mutex.Lock()
+			p := &m.st.Plants[i]
+			p.Level = pushSlice(p.Level, int(level), backlogMinutes)
+			p.Reservoir = &reservoirState{Level: int(level), OK: ps.LimitState == sensorOK, Days: -1}
+			m.mutex.Unlock()
+		})
+	}
+	c.Subscribe(m.config.HumTempTopic+"/temperature", 1, value(func(st *dashboardState, v float64) {
+		st.Temperature = pushSlice(st.Temperature, int(math.Round(v*100)), backlogMinutes)
+	}))
+	c.Subscribe(m.config.HumTempTopic+"/humidity", 1, value(func(st *dashboardState, v float64) {
+		st.Humidity = pushSlice(st.Humidity, int(math.Round(v*100)), backlogMinutes)
+	}))
+}
+
+func (m *mqttSource) name() string {
+	return m.config.Server
+}
+
+func (m *mqttSource) state() (dashboardState, error) {
+	if !m.client.IsConnectionOpen() {
+		return dashboardState{}, fmt.Errorf("not connected to %v", m.config.Server)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// the handlers keep appending to the slices
+	st := m.st
+	st.Temperature = append([]int(nil), st.Temperature...)
+	st.Humidity = append([]int(nil), st.Humidity...)
+	for i := range st.Plants {
+		p := &st.Plants[i]
+		p.Weight = append([]int(nil), p.Weight...)
+		p.Level = append([]int(nil), p.Level...)
+	}
+	return st, nil
+}
+
+func (m *mqttSource) water(index, ms int) (string, error) {
+	topic := [2]string{m.config.Plant1Topic, m.config.Plant2Topic}[index] + "/water/set"
+	token := m.client.Publish(topic, 2, false, strconv.Itoa(ms))
+	if !token.WaitTimeout(mqttTimeout) {
+		return "", fmt.Errorf("timeout while publishing to %v", topic)
+	}
+	if err := token.Error(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("watering of plant %v for %v ms requested", index+1, ms), nil
+}
+
+func (m *mqttSource) close() {
+	m.client.Disconnect(250)
+}
+
+// sparkline draws the values in the given width, averaging the values
+// falling into one column.
+func sparkline(values []int, width int) string {
+	if len(values) == 0 || width <= 0 {
+		return ""
+	}
+	if width > len(values) {
+		width = len(values)
+	}
+
+	cols := make([]float64, width)
+	for c := range cols {
+		from := c * len(values) / width
+		to := (c + 1) * len(values) / width
+		sum := 0
+		for _, v := range values[from:to] {
+			sum += v
+		}
+		cols[c] = float64(sum) / float64(to-from)
+	}
+
+	min, max := cols[0], cols[0]
+	for _, v := range cols {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+
+	blocks := []rune(sparkBlocks)
+	var sb strings.Builder
+	for _, v := range cols {
+		i := 0
+		if max > min {
+			i = int((v - min) / (max - min) * float64(len(blocks)-1))
+		}
+		sb.WriteRune(blocks[i])
+	}
+	return sb.String()
+}
+
+func lastValue(values []int) (int, bool) {
+	if len(values) == 0 {
+		return 0, false
+	}
+	return values[len(values)-1], true
+}
+
+// pad pads the label with spaces to the width in characters.
+func pad(label string, width int) string {
+	if n := utf8.RuneCountInString(label); n < width {
+		return label + strings.Repeat(" ", width-n)
+	}
+	return label
+}
+
+// ago formats the time since t for the dashboard.
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%v min ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%v h ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%v days ago", int(d.Hours()/24))
+	}
+}
+
+// A dashboard shows the state of a station in the terminal.
+type dashboard struct {
+	source dashboardSource
+	st     dashboardState
+	err    error
+	// status is the message of the last action, prompt the input asked
+	// for
+	status string
+	prompt string
+	input  string
+	// plant is the plant to water, ms the confirmed watering time
+	plant int
+	ms    int
+	// watered receives the status of the watering running in the
+	// background, nil while none runs
+	watered chan string
+}
+
+// line writes a line of the frame, raw mode needs the carriage return.
+func line(sb *strings.Builder, format string, args ...interface{}) {
+	fmt.Fprintf(sb, format, args...)
+	sb.WriteString("\x1b[K\r\n")
+}
+
+func (d *dashboard) render(width int) string {
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+
+	line(&sb, "\x1b[1mplantstation\x1b[0m  %v  %v",
+		time.Now().Format("2006-01-02 15:04:05"), d.source.name())
+	if d.err != nil {
+		line(&sb, "\x1b[31m%v\x1b[0m", d.err)
+	} else {
+		line(&sb, "")
+	}
+
+	spark := width - dashboardLabel - 1
+	for i, p := range d.st.Plants {
+		line(&sb, "")
+		line(&sb, "\x1b[1mPlant %v\x1b[0m", i+1)
+
+		label := "weight"
+		if w, ok := lastValue(p.Weight); ok {
+			label = fmt.Sprintf("weight %v", w)
+		}
+		line(&sb, "  %s %s", pad(label, dashboardLabel-2), sparkline(p.Weight, spark))
+
+		label = "reservoir"
+		if r := p.Reservoir; r != nil {
+			label = fmt.Sprintf("reservoir %v", r.Level)
+			if !r.OK {
+				label += " (last read)"
+			}
+		}
+		line(&sb, "  %s %s", pad(label, dashboardLabel-2), sparkline(p.Level, spark))
+
+		if r := p.Reservoir; r != nil && r.Days >= 0 {
+			line(&sb, "  reservoir lasts %.1f days", r.Days)
+		}
+		if p.LastWatering.IsZero() {
+			line(&sb, "  last watering unknown")
+		} else {
+			line(&sb, "  last watering %v, %v ms", ago(p.LastWatering), p.LastMs)
+		}
+	}
+
+	line(&sb, "")
+	label := "temperature"
+	if t, ok := lastValue(d.st.Temperature); ok {
+		label = fmt.Sprintf("temperature %.1f °C", float64(t)/100)
+	}
+	line(&sb, "%s %s", pad(label, dashboardLabel), sparkline(d.st.Temperature, spark))
+	label = "humidity"
+	if h, ok := lastValue(d.st.Humidity); ok {
+		label = fmt.Sprintf("humidity %.1f %%", float64(h)/100)
+	}
+	line(&sb, "%s %s", pad(label, dashboardLabel), sparkline(d.st.Humidity, spark))
+
+	line(&sb, "")
+	if d.prompt != "" {
+		line(&sb, "\x1b[1m%v\x1b[0m%v", d.prompt, d.input)
+	} else {
+		line(&sb, "[1] [2] water plant  [r] refresh  [q] quit")
+		line(&sb, "%v", d.status)
+	}
+	sb.WriteString("\x1b[J")
+	return sb.String()
+}
+
+// key handles a key press and reports whether to quit.
+func (d *dashboard) key(k byte) bool {
+	switch {
+	case d.prompt == "":
+		switch k {
+		case 'q', 3:
+			return true
+		case '1', '2':
+			if d.watered != nil {
+				d.status = "waiting for the running watering"
+				return false
+			}
+			d.plant = int(k - '1')
+			d.ms = 0
+			d.input = ""
+			d.prompt = fmt.Sprintf("water plant %v for ms: ", d.plant+1)
+		case 'r':
+			d.refresh()
+		}
+
+	case k == 27 || k == 3:
+		d.prompt = ""
+		d.status = "watering cancelled"
+
+	case d.ms == 0:
+		switch {
+		case k >= '0' && k <= '9':
+			d.input += string(k)
+		case k == 127 || k == 8:
+			if d.input != "" {
+				d.input = d.input[:len(d.input)-1]
+			}
+		case k == '\r' || k == '\n':
+			ms, err := strconv.Atoi(d.input)
+			if err != nil || ms <= 0 || ms > maxWateringTime {
+				d.prompt = ""
+				d.status = fmt.Sprintf("invalid watering time %q", d.input)
+				return false
+			}
+			d.ms = ms
+			d.input = ""
+			d.prompt = fmt.Sprintf("water plant %v for %v ms? [y/N] ", d.plant+1, ms)
+		}
+
+	default:
+		d.prompt = ""
+		if k != 'y' && k != 'Y' {
+			d.status = "watering cancelled"
+			return false
+		}
+		d.water(d.plant, d.ms)
+	}
+	return false
+}
+
+// water waters the plant in the background, the API returning only after
+// the watering.
+func (d *dashboard) water(index, ms int) {
+	d.status = fmt.Sprintf("watering plant %v for %v ms", index+1, ms)
+	d.watered = make(chan string, 1)
+	go func(done chan<- string) {
+		msg, err := d.source.water(index, ms)
+		if err != nil {
+			msg = fmt.Sprintf("\x1b[31mfailed to water plant %v: %v\x1b[0m", index+1, err)
+		}
+		done <- msg
+	}(d.watered)
+}
+
+// refresh fetches the state, keeping the last one shown if the source
+// fails.
+func (d *dashboard) refresh() {
+	st, err := d.source.state()
+	d.err = err
+	if err == nil {
+		d.st = st
+	}
+}
+
+// run shows the dashboard until q is pressed.
+func (d *dashboard) run(interval time.Duration) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("the dashboard needs a terminal")
+	}
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, old)
+
+	// hide the cursor and use the alternate screen
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan byte)
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(b); err != nil {
+				close(keys)
+				return
+			}
+			keys <- b[0]
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	redraw := time.NewTicker(time.Second)
+	defer redraw.Stop()
+
+	d.refresh()
+	for {
+		width, _, err := term.GetSize(fd)
+		if err != nil || width <= 0 {
+			width = 80
+		}
+		fmt.Print(d.render(width))
+
+		select {
+		case k, ok := <-keys:
+			if !ok || d.key(k) {
+				return nil
+			}
+		case msg := <-d.watered:
+			d.watered = nil
+			d.status = msg
+			d.refresh()
+		case <-ticker.C:
+			d.refresh()
+		case <-redraw.C:
+		}
+	}
+}
+
+// dashboardCommand shows a live dashboard of a station in the terminal.
+func dashboardCommand(argv []string) {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: plantstation dashboard [flags]")
+		fs.PrintDefaults()
+	}
+	var f apiFlags
+	f.register(fs)
+	useMQTT := fs.Bool("mqtt", false, "connect to the MQTT broker of the server config instead of the API")
+	interval := fs.Duration("interval", 10*time.Second, "polling interval of the API")
+	fs.Parse(argv)
+
+	var source dashboardSource
+	if *useMQTT {
+		c, err := f.config.load(nil)
+		if err != nil {
+			log.Fatalf("failed to read server config: %v", err)
+		}
+		if c.MQTT.Server == "" {
+			log.Fatalf("no MQTT server in %s", f.config.path)
+		}
+		m, err := newMQTTSource(c.MQTT)
+		if err != nil {
+			log.Fatalf("failed to connect to MQTT broker: %v", err)
+		}
+		source = m
+	} else {
+		source = &httpSource{client: f.client()}
+	}
+	defer source.close()
+
+	d := &dashboard{source: source}
+	if err := d.run(*interval); err != nil {
+		log.Fatalf("dashboard failed: %v", err)
+	}
+}
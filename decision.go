@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A wateringDecision records why a plant got the amount of water it did.
+type wateringDecision struct {
+	Plant    int       `json:"plant"`
+	Time     time.Time `json:"time"`
+	Strategy string    `json:"strategy"`
+
+	// inputs of the decision
+	Weight  int     `json:"weight"`
+	Target  int     `json:"target"`
+	Dryout  int     `json:"dryout"`
+	Climate float64 `json:"climate"`
+	Scale   int     `json:"scale"`
+	Offset  int     `json:"offset"`
+	LastW   int     `json:"lastw"`
+	DurW    int     `json:"durw"`
+
+	// Branch is the rule the strategy applied for the weight delta and the
+	// computed watering time.
+	Branch   string `json:"branch"`
+	Delta    int    `json:"delta"`
+	Computed int    `json:"computed"`
+	// Clamped is the watering time after clamping to the configured range
+	// and Actual the time the WUC watered, nil until watered.
+	Clamped int  `json:"clamped"`
+	Actual  *int `json:"actual,omitempty"`
+}
+
+// explain logs the branch taken by the strategy and records it with the
+// weight delta and the computed watering time.
+func (in *wateringInput) explain(branch string, delta, ms int) {
+	in.log.Info(branch, "delta", delta, "ms", ms)
+	if d := in.decision; d != nil {
+		d.Branch = branch
+		d.Delta = delta
+		d.Computed = ms
+	}
+}
+
+// addDecision keeps the record of a decision, dropping those older than the
+// backlog. The caller must hold the mutex.
+func (s *station) addDecision(d wateringDecision) {
+	first := time.Now().AddDate(0, 0, -backlogDays)
+	decisions := s.decisions[:0]
+	for _, e := range s.decisions {
+		if e.Time.After(first) {
+			decisions = append(decisions, e)
+		}
+	}
+	s.decisions = append(decisions, d)
+}
+
+// completeDecision sets the actual watering time of the plant's last
+// decision and saves the records.
+func (s *station) completeDecision(index, ms int) {
+	s.mutex.Lock()
+	for i := len(s.decisions) - 1; i >= 0; i-- {
+		if d := &s.decisions[i]; d.Plant == index {
+			if d.Actual == nil {
+				d.Actual = &ms
+			}
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	s.saveDecisions()
+}
+
+func (s *station) readDecisions() {
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.Decisions)
+	if err != nil && os.IsNotExist(err) {
+		logger("storage").Info("no watering decisions found",
+			"file", c.Files.Decisions)
+		return
+	} else if err != nil {
+		log.Fatalf("failed to read watering decisions from %s: %v",
+			c.Files.Decisions, err)
+	}
+
+	err = json.Unmarshal(b, &s.decisions)
+	if err != nil {
+		log.Fatalf("failed to parse watering decisions: %v", err)
+	}
+}
+
+func (s *station) saveDecisions() {
+	c := s.serverConfig()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.decisions)
+	if err != nil {
+		log.Fatalf("failed to marshal watering decisions: %v", err)
+	}
+
+	err = ioutil.WriteFile(c.Files.Decisions, b, 0600)
+	if err != nil {
+		log.Fatalf("failed to save watering decisions to %s: %v",
+			c.Files.Decisions, err)
+	}
+}
+
+// decisionsHandler returns the decision records, newest first, of the
+// plant given by parameter i or of both plants, limited to the last days
+// given by parameter days.
+func decisionsHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		index := -1
+		if _, ok := q["i"]; ok {
+			index = getRequestIndex(r)
+		}
+
+		since := time.Time{}
+		if days := q.Get("days"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = time.Now().AddDate(0, 0, -n)
+		}
+
+		s.mutex.RLock()
+		res := make([]wateringDecision, 0)
+		for i := len(s.decisions) - 1; i >= 0; i-- {
+			d := s.decisions[i]
+			if (index < 0 || d.Plant == index) && d.Time.After(since) {
+				res = append(res, d)
+			}
+		}
+		s.mutex.RUnlock()
+
+		js, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+// minDryoutSamples is the number of hours without watering needed to fit
+// the dryout model.
+const minDryoutSamples = 48
+
+// A dryoutModel predicts the weight loss of a plant per hour by
+//
+//	loss = Intercept + VPD*vpd + HourSin*sin(h) + HourCos*cos(h)
+//	     + Weight*(weight - WeightRef)
+//
+// where vpd is the vapour pressure deficit in kPa and h the hour of the day
+// as angle. The vapour pressure deficit mainly drives evaporation, the hour
+// of the day the plant's uptake and the weight how much water is left.
+type dryoutModel struct {
+	Intercept float64 `json:"intercept"`
+	VPD       float64 `json:"vpd"`
+	HourSin   float64 `json:"hoursin"`
+	HourCos   float64 `json:"hourcos"`
+	Weight    float64 `json:"weight"`
+	WeightRef float64 `json:"weightref"`
+	// RMSE is the root mean square error of the fitted hourly losses.
+	RMSE float64 `json:"rmse"`
+	N    int     `json:"n"`
+	// Prediction is the loss of each of the next 24 hours and Dryout their
+	// sum.
+	Prediction []float64 `json:"prediction"`
+	Dryout     int       `json:"dryout"`
+}
+
+func dryoutFeatures(vpd float64, hour int, weight float64) []float64 {
+	a := float64(hour) * 2 * math.Pi / 24
+	return []float64{1, vpd, math.Sin(a), math.Cos(a), weight}
+}
+
+func (m *dryoutModel) coefficients() []float64 {
+	return []float64{m.Intercept, m.VPD, m.HourSin, m.HourCos, m.Weight}
+}
+
+func (m *dryoutModel) loss(vpd float64, hour int, weight float64) float64 {
+	x := dryoutFeatures(vpd, hour, weight-m.WeightRef)
+	l := 0.0
+	for i, c := range m.coefficients() {
+		l += c * x[i]
+	}
+	return l
+}
+
+// solve solves the linear equations a·x = b by Gaussian elimination with
+// partial pivoting. a and b are modified.
+func solve(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+	for c := 0; c < n; c++ {
+		p := c
+		for r := c + 1; r < n; r++ {
+			if math.Abs(a[r][c]) > math.Abs(a[p][c]) {
+				p = r
+			}
+		}
+		if math.Abs(a[p][c]) < 1e-12 {
+			return nil, false
+		}
+		a[c], a[p] = a[p], a[c]
+		b[c], b[p] = b[p], b[c]
+
+		for r := c + 1; r < n; r++ {
+			f := a[r][c] / a[c][c]
+			for k := c; k < n; k++ {
+				a[r][k] -= f * a[c][k]
+			}
+			b[r] -= f * b[c]
+		}
+	}
+
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		sum := b[r]
+		for k := r + 1; k < n; k++ {
+			sum -= a[r][k] * x[k]
+		}
+		x[r] = sum / a[r][r]
+	}
+	return x, true
+}
+
+// fitDryoutModel fits the dryout model of the plant to the hours without
+// watering by least squares, recent hours weighing more. The caller must
+// hold the mutex.
+func (s *station) fitDryoutModel(index int) (m dryoutModel, ok bool) {
+	d := &s.Data
+	weights := d.Weight[index]
+	n := len(weights)
+	for _, l := range []int{len(d.Watering[index]), len(d.Temperature), len(d.Humidity)} {
+		if l < n {
+			n = l
+		}
+	}
+	if n < minDryoutSamples {
+		return m, false
+	}
+
+	// align the series at their end
+	at := func(series []int, i int) int {
+		return series[len(series)-n+i]
+	}
+	hourOf := func(i int) int {
+		return ((d.Time-(n-1-i))%24 + 24) % 24
+	}
+
+	type sample struct {
+		x    []float64
+		y, w float64
+	}
+	var samples []sample
+	sumw, sumWeight := 0.0, 0.0
+	for i := 1; i < n; i++ {
+		if at(d.Watering[index], i-1) > 0 ||
+			s.boundary(index, d.sampleNumber(len(weights)-n+i, len(weights))) {
+			continue
+		}
+		prev := at(weights, i-1)
+		w := decay(n - i)
+		samples = append(samples, sample{
+			x: dryoutFeatures(vpd(at(d.Temperature, i), at(d.Humidity, i)), hourOf(i), float64(prev)),
+			y: float64(prev - at(weights, i)),
+			w: w,
+		})
+		sumw += w
+		sumWeight += w * float64(prev)
+	}
+	if len(samples) < minDryoutSamples {
+		return m, false
+	}
+	m.WeightRef = sumWeight / sumw
+
+	// weighted normal equations with a little ridge for stability
+	k := len(samples[0].x)
+	a := make([][]float64, k)
+	for i := range a {
+		a[i] = make([]float64, k)
+	}
+	b := make([]float64, k)
+	for _, sm := range samples {
+		sm.x[4] -= m.WeightRef
+		for i := 0; i < k; i++ {
+			b[i] += sm.w * sm.x[i] * sm.y
+			for j := 0; j < k; j++ {
+				a[i][j] += sm.w * sm.x[i] * sm.x[j]
+			}
+		}
+	}
+	for i := 1; i < k; i++ {
+		a[i][i] += 1e-6 * (a[i][i] + 1)
+	}
+
+	c, ok := solve(a, b)
+	if !ok {
+		return m, false
+	}
+	m.Intercept, m.VPD, m.HourSin, m.HourCos, m.Weight = c[0], c[1], c[2], c[3], c[4]
+	m.N = len(samples)
+
+	se := 0.0
+	for _, sm := range samples {
+		r := sm.y
+		for i := range c {
+			r -= c[i] * sm.x[i]
+		}
+		se += sm.w * r * r
+	}
+	m.RMSE = math.Sqrt(se / sumw)
+
+	// the climate of the last 24 hours serves as forecast
+	weight := float64(weights[len(weights)-1])
+	total := 0.0
+	m.Prediction = make([]float64, 24)
+	for h := 0; h < 24; h++ {
+		i := n - 24 + h
+		l := math.Max(0, m.loss(vpd(at(d.Temperature, i), at(d.Humidity, i)), hourOf(i), weight))
+		m.Prediction[h] = l
+		weight -= l
+		total += l
+	}
+	m.Dryout = int(math.Round(total))
+
+	return m, true
+}
+
+func modelHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		index := getRequestIndex(r)
+
+		s.mutex.RLock()
+		m, ok := s.fitDryoutModel(index)
+		s.mutex.RUnlock()
+
+		if !ok {
+			http.Error(w, "not enough data for the dryout model", http.StatusNotFound)
+			return
+		}
+
+		js, err := json.Marshal(m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
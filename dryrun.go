@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// dryRunRequest proposes a plant configuration and optionally a weight.
+type dryRunRequest struct {
+	// Config replaces the plant's configuration, the current one if nil
+	Config *plantConfig `json:"config"`
+	// Weight replaces the current weight of the decision now if not nil
+	Weight *int `json:"weight"`
+}
+
+// replayResult summarizes a replay of the stored history.
+type replayResult struct {
+	Hours     int `json:"hours"`
+	Waterings int `json:"waterings"`
+	// Water and ActualWater are the total watering times in ms of the
+	// replay and of the history.
+	Water       int `json:"water"`
+	ActualWater int `json:"actualwater"`
+	MinWeight   int `json:"minweight"`
+	// DaysBelowLow counts the days with a weight below the low level.
+	DaysBelowLow       int `json:"daysbelowlow"`
+	ActualDaysBelowLow int `json:"actualdaysbelowlow"`
+	// Weights are the replayed hourly weights.
+	Weights []int `json:"weights"`
+}
+
+type dryRunResult struct {
+	Due      bool             `json:"due"`
+	Ms       int              `json:"ms"`
+	Decision wateringDecision `json:"decision"`
+	Replay   replayResult     `json:"replay"`
+}
+
+// gain returns the weight gain of a watering by the watering time model.
+func (in *wateringInput) gain(ms int) int {
+	if in.scale <= 0 || ms <= in.offset {
+		return 0
+	}
+	return (ms - in.offset) / in.scale
+}
+
+// replay replays the stored history of the plant with the configuration.
+// Weights after a watering deviating from the history are shifted by the
+// difference of the weight gains expected by the current model. The caller
+// must hold the mutex.
+func (s *station) replay(index int, config *plantConfig, model *wateringInput) replayResult {
+	d := &s.Data
+	weights := d.Weight[index]
+	waterings := d.Watering[index]
+	n := len(weights)
+	if len(waterings) < n {
+		n = len(waterings)
+	}
+	weights = weights[len(weights)-n:]
+	waterings = waterings[len(waterings)-n:]
+
+	// time of the last sample
+	last := time.Now().Truncate(time.Hour)
+	for i := 0; i < 24 && last.Hour() != d.Time; i++ {
+		last = last.Add(-time.Hour)
+	}
+
+	res := replayResult{Hours: n, Weights: make([]int, n)}
+	if n == 0 {
+		return res
+	}
+	res.MinWeight = weights[0]
+
+	in := *model
+	in.config = config
+	in.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	in.decision = nil
+	in.lastw = 0
+	in.durw = 1
+
+	belowLow := map[string]bool{}
+	actualBelowLow := map[string]bool{}
+	shift := 0
+
+	for i := 0; i < n; i++ {
+		t := last.Add(-time.Duration(n-1-i) * time.Hour)
+		day := t.Format("2006-01-02")
+		w := weights[i] + shift
+
+		res.Weights[i] = w
+		if w < res.MinWeight {
+			res.MinWeight = w
+		}
+		if w < config.LowLevel {
+			belowLow[day] = true
+		}
+		if weights[i] < config.LowLevel {
+			actualBelowLow[day] = true
+		}
+
+		// decisions of the hourly update and of the minutes until the next
+		ms := 0
+		in.weight = w
+		for m := -1; m < 60; m++ {
+			dt := decisionTime{Time: t, hourly: m < 0, loc: s.serverConfig().Location}
+			if m >= 0 {
+				dt.Time = t.Add(time.Duration(m) * time.Minute)
+			}
+			if !config.strategy().due(config, dt) {
+				continue
+			}
+			in.time = dt
+			in.nextHours = config.hoursToNextWindow(dt)
+			in.window = wateringWindow{}
+			if win := config.windowAt(dt); win != nil {
+				in.window = *win
+			}
+			ms += config.strategy().water(&in)
+		}
+
+		if ms > 0 {
+			res.Waterings++
+			res.Water += ms
+			in.lastw = ms
+			in.durw = 1
+		} else {
+			in.durw++
+		}
+		res.ActualWater += waterings[i]
+
+		shift += in.gain(ms) - in.gain(waterings[i])
+	}
+
+	res.DaysBelowLow = len(belowLow)
+	res.ActualDaysBelowLow = len(actualBelowLow)
+	return res
+}
+
+// dryRunHandler shows what the plant's strategy would decide now and over
+// the stored history with a proposed configuration. Nothing is watered or
+// changed.
+func dryRunHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		index := getRequestIndex(r)
+
+		var req dryRunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeValidationError(w, err)
+			return
+		}
+		if req.Config != nil {
+			if err := req.Config.validate(s.serverConfig().Location); err != nil {
+				writeValidationError(w, err)
+				return
+			}
+		}
+
+		weight := 0
+		if req.Weight != nil {
+			weight = *req.Weight
+		} else if s.hasMinuteWeights(index) {
+			weight = s.hourWeight(index)
+		} else {
+			s.mutex.RLock()
+			if n := len(s.Data.Weight[index]); n > 0 {
+				weight = s.Data.Weight[index][n-1]
+			}
+			s.mutex.RUnlock()
+		}
+
+		l := plantLogger("dryrun", index)
+		dt := s.decisionTime(time.Now(), true)
+
+		s.mutex.RLock()
+		config := s.Config[index]
+		if req.Config != nil {
+			config = *req.Config
+		}
+
+		var res dryRunResult
+		res.Due = config.strategy().due(&config, dt)
+		res.Ms, res.Decision, _ = s.planWatering(index, &config, dt, weight, l)
+
+		model := wateringInput{
+			dryout:  res.Decision.Dryout,
+			climate: res.Decision.Climate,
+			scale:   res.Decision.Scale,
+			offset:  res.Decision.Offset,
+		}
+		res.Replay = s.replay(index, &config, &model)
+		s.mutex.RUnlock()
+
+		js, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
+// hasMinuteWeights reports whether minute samples of the plant exist.
+func (s *station) hasMinuteWeights(index int) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.MinData.Weight[index]) > 0
+}
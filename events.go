@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const eventReplant = "replant"
+
+// A plantEvent marks a change of the plant's baseline weight, e.g. after
+// repotting or replacing the plant. Weight changes across such an event are
+// not attributed to dryout or watering. Other events like prevented
+// waterings are only recorded.
+type plantEvent struct {
+	Plant int       `json:"plant"`
+	Kind  string    `json:"kind"`
+	Time  time.Time `json:"time"`
+	// Sample is the number of the first hourly sample after the event.
+	Sample int `json:"sample"`
+	// Delta is the change of the baseline weight.
+	Delta int `json:"delta"`
+
+	// minute is the number of the first minute sample after the event,
+	// minute samples are not persisted and so is this field.
+	minute int
+}
+
+// baseline reports whether the event changes the baseline weight.
+func (e *plantEvent) baseline() bool {
+	return e.Kind == eventReplant
+}
+
+// boundary reports whether an event of the plant lies between the hourly
+// sample with the given number and its predecessor. The caller must hold
+// the mutex.
+func (s *station) boundary(index, sample int) bool {
+	for _, e := range s.Data.Events {
+		if e.Plant == index && e.Sample == sample && e.baseline() {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleNumber returns the number of the sample at position i of a series
+// of length n.
+func (d *measurementData) sampleNumber(i, n int) int {
+	return d.Count - n + i
+}
+
+// pruneEvents drops events older than the hourly backlog. The caller must
+// hold the mutex.
+func (s *station) pruneEvents() {
+	first := s.Data.Count - backlogDays*24
+	events := s.Data.Events[:0]
+	for _, e := range s.Data.Events {
+		if e.Sample > first {
+			events = append(events, e)
+		}
+	}
+	s.Data.Events = events
+}
+
+// hourWeight returns the median of the last hour's minute samples taken
+// after the most recent event and scheduled watering of the plant.
+func (s *station) hourWeight(index int) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	samples := s.MinData.Weight[index]
+	n := len(samples)
+	i0 := 0
+	if n > 60 {
+		i0 = n - 60
+	}
+
+	after := func(minute int) {
+		i := minute - s.MinData.sampleNumber(0, n)
+		if i > i0 && i < n {
+			i0 = i
+		}
+	}
+	for _, e := range s.Data.Events {
+		if e.Plant == index && e.baseline() && time.Since(e.Time) <= time.Hour {
+			after(e.minute)
+		}
+	}
+	after(s.watered[index])
+
+	d := make([]int, n-i0)
+	copy(d, samples[i0:])
+	sort.Ints(d)
+	return d[len(d)/2]
+}
+
+// recordEvent adds an event with the given baseline change of the plant.
+func (s *station) recordEvent(index int, kind string, delta int) plantEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e := plantEvent{
+		Plant:  index,
+		Kind:   kind,
+		Time:   time.Now(),
+		Sample: s.Data.Count,
+		Delta:  delta,
+		minute: s.MinData.Count,
+	}
+	s.Data.Events = append(s.Data.Events, e)
+	return e
+}
+
+// replantHandler records a replant event for the plant. The baseline change
+// is given by parameter d or measured against the last hourly weight.
+func replantHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		index := getRequestIndex(r)
+
+		var delta int
+		if d := r.URL.Query().Get("d"); d != "" {
+			var err error
+			if delta, err = strconv.Atoi(d); err != nil {
+				http.Error(w, fmt.Sprintf("invalid parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+		} else {
+			we, err := s.readWeights()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.mutex.RLock()
+			n := len(s.Data.Weight[index])
+			if n > 0 {
+				delta = we[index] - s.Data.Weight[index][n-1]
+			}
+			s.mutex.RUnlock()
+		}
+
+		e := s.recordEvent(index, eventReplant, delta)
+		plantLogger("events", index).Info("replant", "delta", delta)
+
+		js, err := json.Marshal(e)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailed   = "failed"
+	healthUnknown  = "unknown"
+)
+
+// number of consecutive failures after which a sensor is considered failed
+const maxSensorFailures = 3
+
+// certificates expiring within this duration are reported as degraded
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// A componentStatus tracks the outcome of operations of a component.
+type componentStatus struct {
+	mutex       sync.Mutex
+	lastSuccess time.Time
+	lastError   string
+	failures    int
+}
+
+type componentReport struct {
+	Status      string     `json:"status"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func (c *componentStatus) success() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastSuccess = time.Now()
+	c.failures = 0
+}
+
+func (c *componentStatus) failure(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.failures++
+	c.lastError = err.Error()
+}
+
+func (c *componentStatus) record(err error) {
+	if err != nil {
+		c.failure(err)
+	} else {
+		c.success()
+	}
+}
+
+func (c *componentStatus) report() componentReport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r := componentReport{
+		Status:    healthOK,
+		Failures:  c.failures,
+		LastError: c.lastError,
+	}
+
+	if !c.lastSuccess.IsZero() {
+		t := c.lastSuccess
+		r.LastSuccess = &t
+	}
+
+	switch {
+	case c.failures >= maxSensorFailures:
+		r.Status = healthFailed
+	case c.failures > 0:
+		r.Status = healthDegraded
+	case c.lastSuccess.IsZero():
+		r.Status = healthUnknown
+	}
+
+	return r
+}
+
+// stationHealth holds the health state of the station's components.
+type stationHealth struct {
+	wuc componentStatus
+	sht componentStatus
+
+	mutex      sync.Mutex
+	lastSave   time.Time
+	lastHour   time.Time
+	lastMinute time.Time
+	started    time.Time
+}
+
+func (h *stationHealth) saved() {
+	h.mutex.Lock()
+	h.lastSave = time.Now()
+	h.mutex.Unlock()
+}
+
+func (h *stationHealth) tick(hourly bool) {
+	h.mutex.Lock()
+	if hourly {
+		h.lastHour = time.Now()
+	} else {
+		h.lastMinute = time.Now()
+	}
+	h.mutex.Unlock()
+}
+
+type mqttReport struct {
+	Status    string `json:"status"`
+	Connected bool   `json:"connected"`
+	Queued    int    `json:"queued"`
+}
+
+type persistenceReport struct {
+	Status   string     `json:"status"`
+	LastSave *time.Time `json:"lastSave,omitempty"`
+}
+
+type certReport struct {
+	Status  string     `json:"status"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type schedulerReport struct {
+	Status      string  `json:"status"`
+	SinceHour   float64 `json:"sinceHour"`
+	SinceMinute float64 `json:"sinceMinute"`
+	Uptime      float64 `json:"uptime"`
+}
+
+type healthReport struct {
+	Status      string            `json:"status"`
+	Time        time.Time         `json:"time"`
+	Wuc         componentReport   `json:"wuc"`
+	SHT3x       componentReport   `json:"sht3x"`
+	MQTT        mqttReport        `json:"mqtt"`
+	Persistence persistenceReport `json:"persistence"`
+	Certificate certReport        `json:"certificate"`
+	Scheduler   schedulerReport   `json:"scheduler"`
+}
+
+func (s *station) healthReport() healthReport {
+	now := time.Now()
+	h := &s.health
+
+	r := healthReport{
+		Time:  now,
+		Wuc:   h.wuc.report(),
+		SHT3x: h.sht.report(),
+	}
+
+	if p := s.publisher(); p == nil {
+		r.MQTT.Status = healthUnknown
+	} else {
+		r.MQTT.Connected = p.client.IsConnectionOpen()
+		r.MQTT.Queued = p.queued()
+		r.MQTT.Status = healthOK
+		if !r.MQTT.Connected {
+			r.MQTT.Status = healthDegraded
+		}
+	}
+
+	h.mutex.Lock()
+	lastSave := h.lastSave
+	lastHour := h.lastHour
+	lastMinute := h.lastMinute
+	started := h.started
+	h.mutex.Unlock()
+
+	// the data is saved hourly
+	r.Persistence.Status = healthUnknown
+	if !lastSave.IsZero() {
+		r.Persistence.Status = healthOK
+		r.Persistence.LastSave = &lastSave
+		if now.Sub(lastSave) > 2*time.Hour {
+			r.Persistence.Status = healthDegraded
+		}
+	}
+
+	r.Certificate = certificateReport(s.serverConfig().HTTPS.Cert, now)
+
+	// before the first tick the time since start is used
+	if lastHour.IsZero() {
+		lastHour = started
+	}
+	if lastMinute.IsZero() {
+		lastMinute = started
+	}
+	r.Scheduler.SinceHour = now.Sub(lastHour).Seconds()
+	r.Scheduler.SinceMinute = now.Sub(lastMinute).Seconds()
+	r.Scheduler.Uptime = now.Sub(started).Seconds()
+	r.Scheduler.Status = healthOK
+	if now.Sub(lastMinute) > 3*time.Minute || now.Sub(lastHour) > 2*time.Hour {
+		r.Scheduler.Status = healthFailed
+	}
+
+	r.Status = healthOK
+	for _, status := range []string{
+		r.Wuc.Status,
+		r.SHT3x.Status,
+		r.MQTT.Status,
+		r.Persistence.Status,
+		r.Certificate.Status,
+		r.Scheduler.Status,
+	} {
+		if status == healthFailed {
+			r.Status = healthFailed
+			break
+		} else if status == healthDegraded {
+			r.Status = healthDegraded
+		}
+	}
+
+	return r
+}
+
+func certificateReport(certFile string, now time.Time) certReport {
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		return certReport{Status: healthFailed, Error: err.Error()}
+	}
+
+	expires := cert.NotAfter
+	r := certReport{Status: healthOK, Expires: &expires}
+	if now.After(expires) {
+		r.Status = healthFailed
+	} else if expires.Sub(now) < certExpiryWarning {
+		r.Status = healthDegraded
+	}
+	return r
+}
+
+// readCertificate returns the first certificate of a PEM file.
+func readCertificate(certFile string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %s", certFile)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func healthHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := s.healthReport()
+
+		js, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == healthFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(js)
+	}
+}
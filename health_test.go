@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistenceHealth(t *testing.T) {
+	s := fileStation(t)
+	c := *s.serverConfig()
+	c.Files.Data = filepath.Join(t.TempDir(), "data.json")
+	s.config.Store(&c)
+
+	if r := s.healthReport(); r.Persistence.Status != healthUnknown {
+		t.Errorf("status before saving = %v, want %v", r.Persistence.Status, healthUnknown)
+	}
+
+	s.saveData()
+	if r := s.healthReport(); r.Persistence.Status != healthOK || r.Persistence.LastSave == nil {
+		t.Errorf("report after saving = %+v, want %v", r.Persistence, healthOK)
+	}
+
+	s.health.lastSave = time.Now().Add(-3 * time.Hour)
+	if r := s.healthReport(); r.Persistence.Status != healthDegraded {
+		t.Errorf("status 3 hours after saving = %v, want %v", r.Persistence.Status, healthDegraded)
+	}
+}
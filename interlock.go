@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	sourceScheduler = "scheduler"
+	sourceHTTP      = "http"
+	sourceMQTT      = "mqtt"
+
+	alertDailyLimit  = "daily-limit"
+	alertMaxWaterRun = "max-water-days"
+	alertMinGap      = "min-gap"
+)
+
+// wateringLimits are hard limits enforced in front of every watering. Zero
+// values disable a limit.
+type wateringLimits struct {
+	// DailyMs is the maximum automatic watering time per day
+	DailyMs int `json:"dailyms,omitempty"`
+	// MaxWaterDays is the maximum number of consecutive days with an
+	// automatic watering at the plant's MaxWater
+	MaxWaterDays int `json:"maxdays,omitempty"`
+	// MinGap is the minimum time between waterings in minutes
+	MinGap int `json:"mingap,omitempty"`
+}
+
+// wateringLedger keeps track of the waterings the limits apply to.
+type wateringLedger struct {
+	Last time.Time `json:"last"`
+	// Day and Auto are the date and its automatic watering time.
+	Day  string `json:"day,omitempty"`
+	Auto int    `json:"auto"`
+	// MaxDay and MaxDays are the last date with a watering at MaxWater and
+	// the number of consecutive days up to it.
+	MaxDay  string `json:"maxday,omitempty"`
+	MaxDays int    `json:"maxdays,omitempty"`
+}
+
+type stationLedger struct {
+	Station wateringLedger    `json:"station"`
+	Plants  [2]wateringLedger `json:"plants"`
+}
+
+// An interlockError is returned for a watering prevented by a limit.
+type interlockError struct {
+	kind string
+	msg  string
+}
+
+func (e *interlockError) Error() string {
+	return e.msg
+}
+
+func (l *wateringLedger) auto(day string) int {
+	if l.Day != day {
+		return 0
+	}
+	return l.Auto
+}
+
+func (l *wateringLedger) add(t time.Time, ms int, automatic bool) {
+	l.Last = t
+	if !automatic {
+		return
+	}
+	day := t.Format("2006-01-02")
+	if l.Day != day {
+		l.Day = day
+		l.Auto = 0
+	}
+	l.Auto += ms
+}
+
+// checkGap returns an error if the last watering is less than the gap ago.
+func (l *wateringLedger) checkGap(t time.Time, limits *wateringLimits, what string) error {
+	if limits.MinGap <= 0 || l.Last.IsZero() {
+		return nil
+	}
+	if d := t.Sub(l.Last); d < time.Duration(limits.MinGap)*time.Minute {
+		return &interlockError{alertMinGap, fmt.Sprintf(
+			"last watering of %v %v ago, minimum gap is %v min", what, d.Round(time.Second), limits.MinGap)}
+	}
+	return nil
+}
+
+// dailyRest returns the automatic watering time left for the day, -1 if
+// unlimited.
+func (l *wateringLedger) dailyRest(day string, limits *wateringLimits) int {
+	if limits.DailyMs <= 0 {
+		return -1
+	}
+	if rest := limits.DailyMs - l.auto(day); rest > 0 {
+		return rest
+	}
+	return 0
+}
+
+// checkInterlocks limits the watering time of the plant and returns an error
+// if the watering must not take place. The caller must hold the mutex.
+func (s *station) checkInterlocks(index, ms int, automatic bool, t time.Time) (int, error) {
+	c := s.serverConfig()
+	plant := &s.Ledger.Plants[index]
+	station := &s.Ledger.Station
+	limits := &s.Config[index].Limits
+
+	if err := plant.checkGap(t, limits, fmt.Sprintf("plant %v", index+1)); err != nil {
+		return 0, err
+	}
+	if err := station.checkGap(t, &c.Limits, "the station"); err != nil {
+		return 0, err
+	}
+
+	if !automatic {
+		return ms, nil
+	}
+
+	day := t.Format("2006-01-02")
+	for _, rest := range []int{plant.dailyRest(day, limits), station.dailyRest(day, &c.Limits)} {
+		if rest == 0 {
+			return 0, &interlockError{alertDailyLimit, "daily watering limit reached"}
+		}
+		if rest > 0 && ms > rest {
+			ms = rest
+		}
+	}
+
+	maxDays := limits.MaxWaterDays
+	if maxDays == 0 {
+		maxDays = c.Limits.MaxWaterDays
+	}
+	yesterday := t.AddDate(0, 0, -1).Format("2006-01-02")
+	if maxDays > 0 && ms >= s.Config[index].MaxWater &&
+		plant.MaxDay == yesterday && plant.MaxDays >= maxDays {
+		return 0, &interlockError{alertMaxWaterRun, fmt.Sprintf(
+			"watered maximum on %v consecutive days", plant.MaxDays)}
+	}
+
+	return ms, nil
+}
+
+// recordWatering books the watering in the ledgers. The caller must hold
+// the mutex.
+func (s *station) recordWatering(index, ms int, automatic bool, t time.Time) {
+	plant := &s.Ledger.Plants[index]
+	plant.add(t, ms, automatic)
+	s.Ledger.Station.add(t, ms, automatic)
+
+	if !automatic || ms < s.Config[index].MaxWater {
+		return
+	}
+	day := t.Format("2006-01-02")
+	switch plant.MaxDay {
+	case day:
+	case t.AddDate(0, 0, -1).Format("2006-01-02"):
+		plant.MaxDays++
+	default:
+		plant.MaxDays = 1
+	}
+	plant.MaxDay = day
+}
+
+// water is the single entry to watering a plant. It enforces the limits for
+// waterings from all sources and returns the actual watering time.
+func (s *station) water(index, ms int, source string) (int, error) {
+	s.wateringMutex.Lock()
+	defer s.wateringMutex.Unlock()
+
+	l := plantLogger("interlock", index).With("source", source)
+	automatic := source == sourceScheduler
+	now := time.Now()
+
+	s.mutex.RLock()
+	limited, err := s.checkInterlocks(index, ms, automatic, now)
+	s.mutex.RUnlock()
+
+	if err != nil {
+		l.Warn("watering prevented", "ms", ms, "err", err)
+		if ie, ok := err.(*interlockError); ok {
+			if s.raiseAlert(ie.kind, index, "watering of plant %v from %v prevented: %v",
+				index+1, source, ie.msg) {
+				s.recordEvent(index, ie.kind, 0)
+			}
+		}
+		return 0, err
+	}
+	if limited < ms {
+		l.Warn("watering limited", "ms", ms, "limited", limited)
+	}
+
+	ms = s.wuc.DoWatering(index, limited)
+	wateringCounter.WithLabelValues(plantLabel(index)).Add(float64(ms))
+
+	s.mutex.Lock()
+	s.recordWatering(index, ms, automatic, now)
+	s.mutex.Unlock()
+	s.saveLedger()
+
+	for _, kind := range []string{alertDailyLimit, alertMaxWaterRun, alertMinGap} {
+		s.clearAlert(kind, index)
+	}
+
+	return ms, nil
+}
+
+func (s *station) readLedger() {
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.Ledger)
+	if err != nil && os.IsNotExist(err) {
+		logger("storage").Info("no watering ledger found",
+			"file", c.Files.Ledger)
+		return
+	} else if err != nil {
+		log.Fatalf("failed to read watering ledger from %s: %v",
+			c.Files.Ledger, err)
+	}
+
+	err = json.Unmarshal(b, &s.Ledger)
+	if err != nil {
+		log.Fatalf("failed to parse watering ledger: %v", err)
+	}
+}
+
+func (s *station) saveLedger() {
+	c := s.serverConfig()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.Ledger)
+	if err != nil {
+		log.Fatalf("failed to marshal watering ledger: %v", err)
+	}
+
+	err = ioutil.WriteFile(c.Files.Ledger, b, 0600)
+	if err != nil {
+		log.Fatalf("failed to save watering ledger to %s: %v",
+			c.Files.Ledger, err)
+	}
+}
+
+// subscribeWatering lets plants be watered by MQTT with the watering time
+// in ms published on <PlantTopic>/water/set. Retained requests are ignored,
+// so they are not repeated on every reconnect. The watering runs outside of
+// the MQTT client's router to keep other subscriptions and the keepalive
+// going.
+func (s *station) subscribeWatering() {
+	handler := func(index int) MQTT.MessageHandler {
+		return func(c MQTT.Client, msg MQTT.Message) {
+			l := plantLogger("mqtt", index)
+			if msg.Retained() {
+				l.Warn("ignoring retained watering request", "topic", msg.Topic())
+				return
+			}
+			ms, err := strconv.Atoi(strings.TrimSpace(string(msg.Payload())))
+			if err != nil || ms <= 0 {
+				l.Warn("invalid watering time", "payload", string(msg.Payload()))
+				return
+			}
+			l.Info("watering requested", "ms", ms)
+			topic := strings.TrimSuffix(msg.Topic(), "/set")
+			go func() {
+				if ms, err := s.water(index, ms, sourceMQTT); err == nil {
+					s.publish(topic, byte(2), false, fmt.Sprint(ms))
+				}
+			}()
+		}
+	}
+
+	conf := s.serverConfig()
+	s.mqtt.subscribe(conf.MQTT.Plant1Topic+"/water/set", handler(0))
+	s.mqtt.subscribe(conf.MQTT.Plant2Topic+"/water/set", handler(1))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultLogBufferSize = 1000
+
+// logEntry is a log record kept in the in-memory buffer.
+type logEntry struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"msg"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// A logBuffer keeps the most recent log entries in a ring buffer.
+type logBuffer struct {
+	mutex   sync.Mutex
+	entries []logEntry
+	next    int
+	full    bool
+}
+
+func newLogBuffer(size int) *logBuffer {
+	if size <= 0 {
+		size = defaultLogBufferSize
+	}
+	return &logBuffer{entries: make([]logEntry, size)}
+}
+
+func (b *logBuffer) add(e logEntry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.entries[b.next] = e
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// logFilter selects entries of the log buffer.
+type logFilter struct {
+	level     slog.Level
+	component string
+	plant     string
+	hour      string
+	contains  string
+	since     time.Time
+	limit     int
+}
+
+func (f *logFilter) match(e *logEntry) bool {
+	var level slog.Level
+	if level.UnmarshalText([]byte(e.Level)) == nil && level < f.level {
+		return false
+	}
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if f.contains != "" && !strings.Contains(e.Message, f.contains) {
+		return false
+	}
+	field := func(key, value string) bool {
+		if value == "" {
+			return true
+		}
+		v, ok := e.Fields[key]
+		return ok && fmtField(v) == value
+	}
+	return field("component", f.component) && field("plant", f.plant) && field("hour", f.hour)
+}
+
+func fmtField(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// query returns the matching entries, oldest first.
+func (b *logBuffer) query(f *logFilter) []logEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var ordered []logEntry
+	if b.full {
+		ordered = append(ordered, b.entries[b.next:]...)
+	}
+	ordered = append(ordered, b.entries[:b.next]...)
+
+	res := make([]logEntry, 0)
+	for i := range ordered {
+		if f.match(&ordered[i]) {
+			res = append(res, ordered[i])
+		}
+	}
+
+	if f.limit > 0 && len(res) > f.limit {
+		res = res[len(res)-f.limit:]
+	}
+
+	return res
+}
+
+// bufferHandler passes records to the wrapped handler and keeps a copy in
+// the log buffer.
+type bufferHandler struct {
+	slog.Handler
+	buffer *logBuffer
+	// attrs are the fields added by WithAttrs, their keys prefixed by the
+	// groups open at the time
+	attrs []slog.Attr
+	// group is the prefix of the keys of the open groups like "a.b."
+	group string
+}
+
+func (h *bufferHandler) Handle(ctx context.Context, r slog.Record) error {
+	e := logEntry{
+		Time:    r.Time,
+		Level:   r.Level.String(),
+		Message: r.Message,
+	}
+
+	if len(h.attrs) > 0 || r.NumAttrs() > 0 {
+		e.Fields = make(map[string]interface{}, len(h.attrs)+r.NumAttrs())
+		for _, a := range h.attrs {
+			addField(e.Fields, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addField(e.Fields, h.group, a)
+			return true
+		})
+	}
+
+	h.buffer.add(e)
+
+	return h.Handler.Handle(ctx, r)
+}
+
+// addField adds the attribute to the fields with its key prefixed, the
+// attributes of a group under the group's key. Errors and values with a
+// String method are added as text, which they would not marshal to.
+func addField(fields map[string]interface{}, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			addField(fields, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+
+	var value interface{} = v.Any()
+	if v.Kind() == slog.KindAny {
+		switch x := value.(type) {
+		case error:
+			value = x.Error()
+		case fmt.Stringer:
+			value = x.String()
+		}
+	}
+	fields[prefix+a.Key] = value
+}
+
+func (h *bufferHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := h.attrs[:len(h.attrs):len(h.attrs)]
+	for _, a := range attrs {
+		if a.Key != "" {
+			a.Key = h.group + a.Key
+		} else if a.Value.Kind() == slog.KindGroup {
+			// the inlined group keeps the prefix of the open groups
+			a.Key = strings.TrimSuffix(h.group, ".")
+		}
+		all = append(all, a)
+	}
+	return &bufferHandler{
+		Handler: h.Handler.WithAttrs(attrs),
+		buffer:  h.buffer,
+		attrs:   all,
+		group:   h.group,
+	}
+}
+
+func (h *bufferHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &bufferHandler{
+		Handler: h.Handler.WithGroup(name),
+		buffer:  h.buffer,
+		attrs:   h.attrs,
+		group:   h.group + name + ".",
+	}
+}
+
+// setupLogging installs the default logger writing to w at the given level
+// and returns the buffer of recent entries.
+func setupLogging(w io.Writer, config logConfig) *logBuffer {
+	setLogLevel(config)
+
+	buffer := newLogBuffer(config.Buffer)
+	h := slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(&bufferHandler{Handler: h, buffer: buffer}))
+
+	return buffer
+}
+
+// logLevel is the minimum level logged, changed on reload
+var logLevel = new(slog.LevelVar)
+
+func setLogLevel(config logConfig) {
+	var level slog.Level
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			slog.Warn("invalid log level, using info", "level", config.Level)
+		}
+	}
+	logLevel.Set(level)
+}
+
+// logger returns the default logger with the component field set.
+func logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// plantLogger returns the logger for a component with the plant field set.
+func plantLogger(component string, index int) *slog.Logger {
+	return logger(component).With("plant", index)
+}
+
+func logHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := logFilter{
+			level:     slog.LevelDebug,
+			component: q.Get("component"),
+			plant:     q.Get("i"),
+			hour:      q.Get("hour"),
+			contains:  q.Get("q"),
+		}
+
+		if l := q.Get("level"); l != "" {
+			if err := f.level.UnmarshalText([]byte(l)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if since := q.Get("since"); since != "" {
+			if d, err := time.ParseDuration(since); err == nil {
+				f.since = time.Now().Add(-d)
+			} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+				f.since = t
+			} else {
+				http.Error(w, "invalid since: "+since, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if limit := q.Get("limit"); limit != "" {
+			var err error
+			if f.limit, err = strconv.Atoi(limit); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		js, err := json.Marshal(s.logs.query(&f))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBufferHandlerFields(t *testing.T) {
+	buffer := newLogBuffer(10)
+	h := slog.NewTextHandler(io.Discard, nil)
+	l := slog.New(&bufferHandler{Handler: h, buffer: buffer})
+
+	l.With("component", "test").WithGroup("mqtt").With("broker", "tcp://pi:1883").
+		Info("failed", "err", errors.New("refused"), "wait", 5*time.Second,
+			slog.Group("queue", "len", 3))
+
+	entries := buffer.query(&logFilter{component: "test"})
+	if len(entries) != 1 {
+		t.Fatalf("%v entries, want 1", len(entries))
+	}
+	want := map[string]interface{}{
+		"component":      "test",
+		"mqtt.broker":    "tcp://pi:1883",
+		"mqtt.err":       "refused",
+		"mqtt.wait":      5 * time.Second,
+		"mqtt.queue.len": int64(3),
+	}
+	fields := entries[0].Fields
+	if len(fields) != len(want) {
+		t.Errorf("fields %v, want %v", fields, want)
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%v = %#v, want %#v", k, fields[k], v)
+		}
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -14,16 +15,14 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
-
 	auth "github.com/abbot/go-http-auth"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gobot.io/x/gobot/drivers/i2c"
 	"gobot.io/x/gobot/platforms/raspi"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 const backlogMinutes = 8 * 60
@@ -34,19 +33,52 @@ type station struct {
 	MinData          measurementData     `json:"mindata"`
 	Config           [2]plantConfig      `json:"config"`
 	WateringTimeData [2]wateringTimeData `json:"watertime"`
+	Calibration      [2]scaleCalibration `json:"calibration"`
+	Modes            stationModes        `json:"modes"`
+	ReservoirStatus  [2]reservoirState   `json:"reservoir"`
+	Ledger           stationLedger       `json:"ledger"`
+	Alerts           []alert             `json:"alerts"`
 
 	mutex         sync.RWMutex
 	whitelistNets []net.IPNet
 	sht           *i2c.SHT3xDriver
 	wuc           *Wuc
-	serverConfig  `json:"-"`
-
-	mqttClient MQTT.Client
+	// config is the server configuration, replaced as a whole on reload
+	config atomic.Pointer[serverConfig]
+
+	// configFile is the server config file, reloaded on SIGHUP with the
+	// overrides given on the command line
+	configFile      configFileFlag
+	configOverrides configOverrides
+	reloadMutex     sync.Mutex
+	https           httpsListener
+
+	mqtt       *mqttPublisher
+	mqttMutex  sync.RWMutex
+	waterLimit [2]int
+	health     stationHealth
+	logs       *logBuffer
+
+	calibrationSessions [2]*calibrationSession
+	// watered is the number of the first minute sample after the last
+	// scheduled watering of each plant
+	watered [2]int
+	verify  [2]*pendingVerification
+
+	// decisions are the records of the watering decisions
+	decisions []wateringDecision
+	// configHistory are the versions of the plant configuration
+	configHistory []configVersion
+
+	// wateringMutex serializes waterings from all sources
+	wateringMutex sync.Mutex
 }
 
 type wateringTimeData struct {
 	Scale  int `json:"scale"`
 	Offset int `json:"offset"`
+	// Fit is the last fit of the model with its confidence intervals.
+	Fit *lineFit `json:"fit,omitempty"`
 }
 
 type measurementData struct {
@@ -54,7 +86,11 @@ type measurementData struct {
 	Temperature []int    `json:"temperature"`
 	Humidity    []int    `json:"humidity"`
 	Watering    [2][]int `json:"water"`
+	Level       [2][]int `json:"level"`
 	Time        int      `json:"time"`
+	// Count is the total number of samples taken.
+	Count  int          `json:"count"`
+	Events []plantEvent `json:"events,omitempty"`
 }
 
 type plantConfig struct {
@@ -64,11 +100,24 @@ type plantConfig struct {
 	LowLevel   int `json:"low"`
 	HighLevel  int `json:"dst"`
 	LevelRange int `json:"range"`
+	// Strategy selects the watering strategy, threshold refill by default.
+	Strategy string `json:"strategy,omitempty"`
+	// Schedule lists the waterings of the fixed schedule strategy.
+	Schedule []scheduledWatering `json:"schedule,omitempty"`
+	// Gain is the watering time in ms per weight unit of the proportional
+	// strategy.
+	Gain float64 `json:"gain,omitempty"`
+	// Windows lists the hours of watering decisions, replacing WaterHour.
+	Windows []wateringWindow `json:"windows,omitempty"`
+	// Limits are the plant's hard watering limits.
+	Limits wateringLimits `json:"limits"`
 }
 
 type loginConfig struct {
 	User string
-	Pass string
+	Pass string `secret:"true"`
+	// PassFile is read for Pass
+	PassFile string
 }
 
 type httpsConfig struct {
@@ -78,9 +127,16 @@ type httpsConfig struct {
 }
 
 type filesConfig struct {
-	Config    string
-	Data      string
-	WaterTime string
+	Config      string
+	Data        string
+	WaterTime   string
+	MQTTQueue   string
+	Calibration string
+	// Mode, Ledger and History are stored next to Config unless given
+	Mode      string
+	Ledger    string
+	Decisions string
+	History   string
 }
 
 type mqttConfig struct {
@@ -90,7 +146,38 @@ type mqttConfig struct {
 	HumTempTopic string
 	ClientID     string
 	User         string
-	Pass         string
+	Pass         string `secret:"true"`
+	// PassFile is read for Pass
+	PassFile    string
+	StatusTopic string
+	QueueSize   int
+	CACert      string
+	ClientCert  string
+	ClientKey   string
+	// Payload selects "value" for plain values only or "json" for
+	// additional state documents
+	Payload string
+	// ModeTopic publishes the station-wide mode, which is set on
+	// ModeTopic/set
+	ModeTopic string
+	// AlertTopic publishes active alerts as AlertTopic/<kind>/<plant>
+	AlertTopic string
+}
+
+type logConfig struct {
+	// Level is the minimum level logged, one of debug, info, warn or error
+	Level string
+	// Buffer is the number of recent entries kept for /log
+	Buffer int
+}
+
+type reservoirConfig struct {
+	// Low is the level below which waterings are shortened
+	Low int
+	// Empty is the level at which waterings are skipped
+	Empty int
+	// AlertDays is the estimated number of days left raising an alert
+	AlertDays float64
 }
 
 type serverConfig struct {
@@ -98,41 +185,67 @@ type serverConfig struct {
 	Login loginConfig
 	Files filesConfig
 	MQTT  mqttConfig
+	Log   logConfig
+	// Reservoir holds the low water thresholds
+	Reservoir reservoirConfig
+	// Limits are the station-wide watering limits, DailyMs and MinGap
+	// apply to both plants together
+	Limits wateringLimits
+	// Location is used for schedules relative to sunrise and sunset
+	Location location
 }
 
-func main() {
+// serverConfig returns the current server configuration. It must not be
+// modified, a reload replaces it.
+func (s *station) serverConfig() *serverConfig {
+	return s.config.Load()
+}
 
-	// waitForTimeSync()
+func main() {
+	runCommand(os.Args[1:])
+}
 
-	log.Print("start")
+// serve runs the station.
+func serve(args []string) {
 
-	var sconfFile string
-	flag.StringVar(&sconfFile, "c", "server.conf", "server config file")
-	flag.Parse()
+	// waitForTimeSync()
 
-	r := raspi.NewAdaptor()
-	w, err := NewWuc(r)
-	if err != nil {
-		log.Fatalf("failed to create connection to microcontroller: %v", err)
+	var diff string
+	sconfFile := newConfigFileFlag()
+	var history, printConfig bool
+	var rollback int
+	var overrides configOverrides
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fmt.Fprintln(fs.Output(), "\nflags of serve:")
+		fs.PrintDefaults()
 	}
+	fs.Var(&sconfFile, "c", "server config `file`")
+	fs.Var(&overrides, "set", "override server config `Section.Field=value`, may be repeated")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective server config with secrets redacted and exit")
+	fs.BoolVar(&history, "history", false, "list the plant config versions and exit")
+	fs.StringVar(&diff, "diff", "", "show the changes between plant config versions `from:to` and exit")
+	fs.IntVar(&rollback, "rollback", 0, "restore plant config `version`, through the API if the station runs, and exit")
+	fs.Parse(args)
+
+	if printConfig {
+		c, err := sconfFile.load(overrides)
+		if err != nil {
+			log.Fatalf("failed to read server config: %v", err)
+		}
+		if err = printServerConfig(os.Stdout, c); err != nil {
+			log.Fatalf("failed to print server config: %v", err)
+		}
+		if err = c.validate(); err != nil {
+			log.Fatalf("invalid server config: %v", err)
+		}
+		return
+	}
+
+	slog.Info("start")
 
 	s := station{
-		serverConfig: serverConfig{
-			Login: loginConfig{
-				User: "user",
-				Pass: "",
-			},
-			HTTPS: httpsConfig{
-				Addr: ":443",
-				Cert: "localhost.crt",
-				Key:  "localhost.key",
-			},
-			Files: filesConfig{
-				Config:    "/var/opt/plantstation/plant.conf",
-				Data:      "/var/opt/plantstation/data.json",
-				WaterTime: "/var/opt/plantstation/watertime.json",
-			},
-		},
 		Config: [2]plantConfig{{
 			WaterHour:  7,
 			WaterStart: 2000,
@@ -148,8 +261,6 @@ func main() {
 			HighLevel:  1500,
 			LevelRange: 100,
 		}},
-		sht: i2c.NewSHT3xDriver(r),
-		wuc: w,
 		Data: measurementData{
 			Time:        time.Now().Hour(),
 			Weight:      [2][]int{make([]int, 0), make([]int, 0)},
@@ -159,18 +270,35 @@ func main() {
 		},
 	}
 
-	s.parseServerConfigFile(sconfFile)
+	s.health.started = time.Now()
+
+	s.parseServerConfigFile(sconfFile, overrides)
+	s.logs = setupLogging(os.Stderr, s.serverConfig().Log)
 	s.parsePlantConfigFile()
+	s.readCalibration()
+	s.readConfigHistory()
+	if s.configHistoryCommand(os.Stdout, history, diff, rollback) {
+		return
+	}
+
+	r := raspi.NewAdaptor()
+	w, err := NewWuc(r)
+	if err != nil {
+		log.Fatalf("failed to create connection to microcontroller: %v", err)
+	}
+	s.sht = i2c.NewSHT3xDriver(r)
+	s.wuc = w
+
 	s.readData()
 	s.readWateringTime()
+	s.readModes()
+	s.readLedger()
+	s.readDecisions()
 
-	if s.MQTT.Server != "" {
-		connOpts := MQTT.NewClientOptions().AddBroker(s.MQTT.Server)
-		connOpts.SetClientID(s.MQTT.ClientID)
-		connOpts.SetUsername(s.MQTT.User)
-		connOpts.SetPassword(s.MQTT.Pass)
-
-		s.mqttClient = MQTT.NewClient(connOpts)
+	if s.serverConfig().MQTT.Server != "" {
+		if err = s.startMQTT(); err != nil {
+			log.Fatalf("failed to create MQTT client: %v", err)
+		}
 	}
 
 	err = s.sht.Start()
@@ -180,21 +308,31 @@ func main() {
 
 	authenticator := auth.NewBasicAuthenticator("plant", s.secret())
 
-	// TODO: create own server instance and do graceful shutdown on signal
-	// server := &http.Server{
-	// 	Addr: s.serverConfig.HTTPS.Addr,
-	// }
-
 	http.Handle("/", http.FileServer(http.Dir("web")))
 	http.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/", http.FileServer(http.Dir(""))))
-	http.HandleFunc("/water", auth.JustCheck(authenticator, wateringHandler(&s)))
-	http.HandleFunc("/calc", calcWateringHandler(&s))
-	http.HandleFunc("/weight", weightHandler(&s))
-	http.HandleFunc("/limit", waterLimitHandler(&s))
-	http.HandleFunc("/ht", htHandler(&s))
-	http.HandleFunc("/data", dataHandler(&s))
-	http.HandleFunc("/config", auth.JustCheck(authenticator, configHandler(&s)))
-	http.HandleFunc("/echo", echoHandler(&s))
+	http.HandleFunc("/water", instrument("water", auth.JustCheck(authenticator, wateringHandler(&s))))
+	http.HandleFunc("/calc", instrument("calc", calcWateringHandler(&s)))
+	http.HandleFunc("/model", instrument("model", modelHandler(&s)))
+	http.HandleFunc("/decisions", instrument("decisions", decisionsHandler(&s)))
+	http.HandleFunc("/dryrun", instrument("dryrun", auth.JustCheck(authenticator, dryRunHandler(&s))))
+	http.HandleFunc("/weight", instrument("weight", weightHandler(&s)))
+	http.HandleFunc("/limit", instrument("limit", waterLimitHandler(&s)))
+	http.HandleFunc("/ht", instrument("ht", htHandler(&s)))
+	http.HandleFunc("/data", instrument("data", dataHandler(&s)))
+	http.HandleFunc("/config", instrument("config", auth.JustCheck(authenticator, configHandler(&s))))
+	http.HandleFunc("/history", instrument("history", auth.JustCheck(authenticator, historyHandler(&s))))
+	http.HandleFunc("/diff", instrument("diff", auth.JustCheck(authenticator, diffHandler(&s))))
+	http.HandleFunc("/rollback", instrument("rollback", auth.JustCheck(authenticator, rollbackHandler(&s))))
+	http.HandleFunc("/calibrate", instrument("calibrate", auth.JustCheck(authenticator, calibrationHandler(&s))))
+	http.HandleFunc("/replant", instrument("replant", auth.JustCheck(authenticator, replantHandler(&s))))
+	http.HandleFunc("/mode", instrument("mode", auth.JustCheck(authenticator, modeHandler(&s))))
+	http.HandleFunc("/echo", instrument("echo", echoHandler(&s)))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/health", instrument("health", healthHandler(&s)))
+	http.HandleFunc("/log", instrument("log", auth.JustCheck(authenticator, logHandler(&s))))
+	http.HandleFunc("/alerts", instrument("alerts", alertsHandler(&s)))
+	http.HandleFunc("/ack", instrument("ack", auth.JustCheck(authenticator, ackHandler(&s))))
+	http.HandleFunc("/reload", instrument("reload", auth.JustCheck(authenticator, reloadHandler(&s))))
 
 	sigsave := make(chan os.Signal, 1)
 	signal.Notify(sigsave, syscall.SIGUSR1)
@@ -204,7 +342,19 @@ func main() {
 			<-sigsave
 			s.saveData()
 			s.saveWateringTime()
-			log.Print("data saved")
+			logger("storage").Info("data saved")
+		}
+	}()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-sighup
+			if _, err := s.reloadServerConfig(); err != nil {
+				logger("config").Error("invalid server config, keeping current", "err", err)
+			}
 		}
 	}()
 
@@ -213,16 +363,15 @@ func main() {
 
 	go s.run()
 
-	go func() {
-		log.Fatal(http.ListenAndServeTLS(
-			s.serverConfig.HTTPS.Addr,
-			s.serverConfig.HTTPS.Cert,
-			s.serverConfig.HTTPS.Key,
-			nil))
-	}()
+	if err = s.https.listen(s.serverConfig().HTTPS); err != nil {
+		log.Fatalf("failed to listen on %v: %v", s.serverConfig().HTTPS.Addr, err)
+	}
 
 	<-sigs
-	log.Print("shutting down")
+	slog.Info("shutting down")
+
+	s.https.shutdown()
+	s.stopMQTT()
 
 	s.saveData()
 	s.saveWateringTime()
@@ -230,10 +379,11 @@ func main() {
 }
 
 func (s *station) parsePlantConfigFile() {
-	fw := s.serverConfig.Files.Config
+	c := s.serverConfig()
+	fw := c.Files.Config
 	b, err := ioutil.ReadFile(fw)
 	if err != nil && os.IsNotExist(err) {
-		log.Printf("watering config %s not found, using default", fw)
+		logger("storage").Info("watering config not found, using default", "file", fw)
 		return
 	} else if err != nil {
 		log.Fatalf("failed to read %s: %v", fw, err)
@@ -243,29 +393,40 @@ func (s *station) parsePlantConfigFile() {
 	if err != nil {
 		log.Fatalf("failed to parse watering config: %v", err)
 	}
+
+	if err = validatePlantConfigs(&s.Config, c.Location); err != nil {
+		for _, e := range err.(validationErrors) {
+			logger("config").Error("invalid watering config", "field", e.Field, "err", e.Message)
+		}
+		log.Fatalf("invalid watering config in %s: %v", fw, err)
+	}
 }
 
-func (s *station) parseServerConfigFile(serverConf string) {
-	b, err := ioutil.ReadFile(serverConf)
+func (s *station) parseServerConfigFile(serverConf configFileFlag, overrides configOverrides) {
+	c, err := serverConf.load(overrides)
 	if err != nil {
-		log.Fatalf("failed to read %s: %v", serverConf, err)
+		log.Fatalf("failed to read server config: %v", err)
 	}
 
-	err = toml.Unmarshal(b, &s.serverConfig)
-	if err != nil {
-		log.Fatalf("failed to parse server config: %v", err)
+	if err = c.validate(); err != nil {
+		log.Fatalf("invalid server config in %s: %v", serverConf.path, err)
 	}
+
+	s.config.Store(&c)
+	s.configFile = serverConf
+	s.configOverrides = overrides
 }
 
 func (s *station) readWateringTime() {
-	b, err := ioutil.ReadFile(s.serverConfig.Files.WaterTime)
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.WaterTime)
 	if err != nil && os.IsNotExist(err) {
-		log.Printf("no old watering time data found at %s",
-			s.serverConfig.Files.WaterTime)
+		logger("storage").Info("no old watering time data found",
+			"file", c.Files.WaterTime)
 		return
 	} else if err != nil {
 		log.Fatalf("failed to read watering time data to %s: %v",
-			s.serverConfig.Files.WaterTime, err)
+			c.Files.WaterTime, err)
 	}
 
 	err = json.Unmarshal(b, &s.WateringTimeData)
@@ -275,6 +436,7 @@ func (s *station) readWateringTime() {
 }
 
 func (s *station) saveWateringTime() {
+	c := s.serverConfig()
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
@@ -283,31 +445,41 @@ func (s *station) saveWateringTime() {
 		log.Fatalf("failed to marshal watering time data: %v", err)
 	}
 
-	err = ioutil.WriteFile(s.serverConfig.Files.WaterTime, b, 0600)
+	err = ioutil.WriteFile(c.Files.WaterTime, b, 0600)
 	if err != nil {
 		log.Fatalf("failed to save watering time data to %s: %v",
-			s.serverConfig.Files.WaterTime, err)
+			c.Files.WaterTime, err)
 	}
+	s.health.saved()
 }
 
 func (s *station) readData() {
-	b, err := ioutil.ReadFile(s.serverConfig.Files.Data)
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.Data)
 	if err != nil && os.IsNotExist(err) {
-		log.Printf("no old measurement data found at %s",
-			s.serverConfig.Files.Data)
+		logger("storage").Info("no old measurement data found",
+			"file", c.Files.Data)
 		return
 	} else if err != nil {
 		log.Fatalf("failed to read measurement data to %s: %v",
-			s.serverConfig.Files.Data, err)
+			c.Files.Data, err)
 	}
 
 	err = json.Unmarshal(b, &s.Data)
 	if err != nil {
 		log.Fatalf("failed to marshal measurement data: %v", err)
 	}
+
+	// data saved before samples were counted
+	for _, d := range s.Data.Weight {
+		if s.Data.Count < len(d) {
+			s.Data.Count = len(d)
+		}
+	}
 }
 
 func (s *station) saveData() {
+	c := s.serverConfig()
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
@@ -316,29 +488,18 @@ func (s *station) saveData() {
 		log.Fatalf("failed to marshal measurement data: %v", err)
 	}
 
-	err = ioutil.WriteFile(s.serverConfig.Files.Data, b, 0600)
+	err = ioutil.WriteFile(c.Files.Data, b, 0600)
 	if err != nil {
 		log.Fatalf("failed to save measurement data to %s: %v",
-			s.serverConfig.Files.Data, err)
+			c.Files.Data, err)
 	}
+	s.health.saved()
 }
 
-func (s *station) publish(topic string, qos byte, retained bool, payload string) error {
-
-	const timeout = time.Second * 10
-
-	if !s.mqttClient.IsConnected() {
-		log.Print("connecting to MQTT broker")
-		if token := s.mqttClient.Connect(); token.WaitTimeout(timeout) && token.Error() != nil {
-			return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
-		}
+func (s *station) publish(topic string, qos byte, retained bool, payload string) {
+	if p := s.publisher(); p != nil {
+		p.publish(topic, qos, retained, payload)
 	}
-
-	if token := s.mqttClient.Publish(topic, qos, retained, payload); token.WaitTimeout(timeout) && token.Error() != nil {
-		return fmt.Errorf("timeout while publishing: %v", token.Error())
-	}
-
-	return nil
 }
 
 func (s *station) run() {
@@ -358,8 +519,12 @@ func (s *station) run() {
 			h := time.Now().Add(30 * time.Minute).Hour()
 			// next hour
 			n := time.Now().Add(90 * time.Minute)
-			log.Printf("update %v", h)
+			logger("scheduler").Info("update", "hour", h)
+			s.health.tick(true)
 			s.update(h)
+			// keep the data of a power loss to the last hour
+			s.saveData()
+			s.saveWateringTime()
 			// reset timer to next hour
 			timer.Reset(time.Until(time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), 0, 0, 0, n.Location())))
 
@@ -368,7 +533,8 @@ func (s *station) run() {
 			m := time.Now().Add(30 * time.Second).Minute()
 			// next hour
 			n := time.Now().Add(90 * time.Second)
-			log.Printf("minute %v", m)
+			logger("scheduler").Debug("minute", "minute", m)
+			s.health.tick(false)
 			s.updateMinute(m)
 			mintimer.Reset(time.Until(time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), n.Minute(), 0, 0, n.Location())))
 		}
@@ -384,9 +550,11 @@ func pushSlice(s []int, v int, maxLen int) []int {
 	return append(s, v)
 }
 
-func (s *station) calculateDryoutAndWateringTime(index int) (dryout, wateringTimeScale, wateringTimeOffset int) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+// calculateDryoutAndWateringTime returns the dryout per 24h and the
+// watering time model fitted to the waterings. Recent waterings weigh more.
+// The caller must hold the mutex.
+func (s *station) calculateDryoutAndWateringTime(index int) (dryout, wateringTimeScale, wateringTimeOffset int, fit lineFit) {
+	l := plantLogger("watering", index)
 
 	dryoutSamples := make([]int, 0, len(s.Data.Weight))
 	prevw := 0
@@ -394,33 +562,24 @@ func (s *station) calculateDryoutAndWateringTime(index int) (dryout, wateringTim
 	numw := len(s.Data.Watering[index])
 	numm := len(s.Data.Weight[index])
 
-	// number of waterings
-	wn := float32(0)
-	// weight gain sum
-	wgsum := float32(0)
-	// squared sum of weight gain
-	wgsum2 := float32(0)
-	// watering time sum
-	wtsum := float32(0)
-	// dot product of weight gains and watering times
-	wgwtdot := float32(0)
-
-	addWatering := func(wg, wt float32) {
-		wgsum += wg
-		wtsum += wt
-		wgsum2 += wg * wg
-		wgwtdot += wt * wg
-		wn++
-	}
+	// weight gains and watering times
+	var points []weightedPoint
 
 	for i, w := range s.Data.Watering[index] {
 		if numw-i < numm {
-			m := s.Data.Weight[index][numm-numw+i]
+			j := numm - numw + i
+			m := s.Data.Weight[index][j]
+			if s.boundary(index, s.Data.sampleNumber(j, numm)) {
+				// do not relate weights across a baseline change
+				prevm = 0
+			}
 			if prevm > 0 {
 				if prevw > 0 {
-					fw := float32(prevw)
-					wg := float32(m - prevm)
-					addWatering(wg, fw)
+					points = append(points, weightedPoint{
+						x: float64(m - prevm),
+						y: float64(prevw),
+						w: decay(numw - i),
+					})
 				} else {
 					dryoutSamples = append(dryoutSamples, prevm-m)
 				}
@@ -430,20 +589,6 @@ func (s *station) calculateDryoutAndWateringTime(index int) (dryout, wateringTim
 		prevw = w
 	}
 
-	if s.WateringTimeData[index].Scale > 0 && wn > 0 {
-		// add two data points 12.5% around weightgain average calculated from previous data for stable results
-		wgavg := wgsum / wn
-		wg1 := (wgavg - wgavg/8)
-		wg2 := (wgavg + wgavg/8)
-		wt1 := wg1*float32(s.WateringTimeData[index].Scale) +
-			float32(s.WateringTimeData[index].Offset)
-		wt2 := wg2*float32(s.WateringTimeData[index].Scale) +
-			float32(s.WateringTimeData[index].Offset)
-
-		addWatering(wg1, wt1)
-		addWatering(wg2, wt2)
-	}
-
 	if len(dryoutSamples) > 0 {
 		sort.Ints(dryoutSamples)
 		n := len(dryoutSamples)
@@ -457,57 +602,68 @@ func (s *station) calculateDryoutAndWateringTime(index int) (dryout, wateringTim
 		}
 		dryout = (sum*24 + na/2) / na
 	} else {
-		log.Println("no dryout meassured")
+		l.Warn("no dryout measured")
 		dryout = 0
 	}
 
-	if wn > 0 && wgsum*wgsum < wgsum2*wn {
-		wts := (wgwtdot - wtsum*wgsum/wn) / (wgsum2 - wgsum*wgsum/wn)
-		wateringTimeOffset = int(wtsum/wn - wts*wgsum/wn)
-		wateringTimeScale = int(wts)
-	} else {
-		log.Println("cannot calculate watering times")
-		log.Printf("wn: %v\n", wn)
-		log.Printf("wgsum: %v\n", wgsum)
-		log.Printf("wgsum2: %v\n", wgsum2)
-		log.Printf("wtsum: %v\n", wtsum)
-		log.Printf("wgwtdot: %v\n", wgwtdot)
+	fit, ok := theilSen(points)
+	if ok && fit.Offset < 0 {
+		// a watering does not take negative time, fit through the origin
+		l.Info("negative offset, fitting through origin",
+			"scale", fit.Scale, "offset", fit.Offset)
+		fit, ok = originFit(points)
+	}
+
+	if !ok || fit.Scale < 1 {
+		l.Warn("cannot calculate watering times",
+			"waterings", len(points), "scale", fit.Scale, "offset", fit.Offset)
 
 		// fallback to old settings
 		wateringTimeOffset = s.WateringTimeData[index].Offset
 		wateringTimeScale = s.WateringTimeData[index].Scale
+		return dryout, wateringTimeScale, wateringTimeOffset, lineFit{}
 	}
 
-	// check results
-	if wateringTimeOffset < 0 {
-		// clamp offset to zero, and calculate line through center of mass
-		log.Printf("clamping offset:  %v, %v",
-			wateringTimeScale, wateringTimeOffset)
-		wateringTimeOffset = 0
-		if wgsum > 0 {
-			wateringTimeScale = int(wtsum / wgsum)
-		}
-	} else if wateringTimeScale < 1 {
-		// set offset to half of average watering time,
-		// and calculate line through center of mass
-		log.Printf("clamping scale:  %v, %v",
-			wateringTimeScale, wateringTimeOffset)
-		if wn > 0 {
-			wateringTimeOffset = int(0.5 * wtsum / wn)
-		}
-		wateringTimeScale = int(wtsum * 0.5 / wgsum)
-	}
+	l.Debug("watering times fitted", "waterings", fit.N,
+		"scale", fit.Scale, "scaleci", fit.ScaleCI,
+		"offset", fit.Offset, "offsetci", fit.OffsetCI)
 
+	wateringTimeScale = int(math.Round(fit.Scale))
+	wateringTimeOffset = int(math.Round(fit.Offset))
 	return
 }
 
-func (s *station) calculateWatering(index int, hour int, weight int, save bool) int {
+func (s *station) calculateWatering(index int, dt decisionTime, weight int, save bool) int {
+	l := plantLogger("watering", index).With("hour", dt.Hour())
+	if !dt.hourly {
+		l = l.With("minute", dt.Minute())
+	}
+
 	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	c := s.modeConfig(index)
+	wt, d, fit := s.planWatering(index, &c, dt, weight, l)
+	s.mutex.RUnlock()
 
-	config := &s.Config[index]
+	if save {
+		s.mutex.Lock()
+		wateringTimeData := &s.WateringTimeData[index]
+		wateringTimeData.Offset = d.Offset
+		wateringTimeData.Scale = d.Scale
+		if fit.N > 0 {
+			wateringTimeData.Fit = &fit
+		}
+		s.addDecision(d)
+		s.mutex.Unlock()
+	}
+
+	return wt
+}
+
+// planWatering returns the watering time the strategy of the config decides
+// on, the record of the decision and the fitted watering time model. It does
+// not change the station. The caller must hold the mutex.
+func (s *station) planWatering(index int, config *plantConfig, dt decisionTime, weight int, l *slog.Logger) (int, wateringDecision, lineFit) {
 	watering := s.Data.Watering[index]
-	wateringTimeData := &s.WateringTimeData[index]
 
 	lastw := 0
 	durw := 1
@@ -527,64 +683,80 @@ func (s *station) calculateWatering(index int, hour int, weight int, save bool)
 		prevw = s.Data.Weight[index][len(s.Data.Weight[index])-durw+1]
 	}
 
-	log.Printf("last watered %v hours ago, watered %vs, last weight: %v",
-		durw, lastw, prevw)
+	l.Info("last watering",
+		"hours", durw, "ms", lastw, "weight", prevw)
 
 	// dryout per 24h, watering time scale, water time offset
-	dryout, wts, wto := s.calculateDryoutAndWateringTime(index)
-
-	wtime := func(dw int) int {
-		return wts*dw + wto
-	}
-	abs := func(i int) int {
-		if i < 0 {
-			return -i
-		}
-		return i
-	}
-
-	dw := 0
-	wt := 0
-	minLevel := s.Config[index].LowLevel + dryout*23/24
-
-	if weight <= s.Config[index].LowLevel {
-		// full refill
-		dw = s.Config[index].HighLevel - weight
-		wt = wtime(dw)
-		log.Printf("full refill")
-	} else if weight < minLevel {
-		dwhi := s.Config[index].HighLevel - weight
-		dwlo := minLevel - weight
-		hiwt := wtime(dwhi)
-		lowt := wtime(dwlo)
-		// clamp to high level
-		if minLevel > s.Config[index].HighLevel {
-			log.Print("clamping refill to high level")
-			dw = dwhi
-			wt = hiwt
-		} else if abs(hiwt-lastw) > abs(lowt-lastw) {
-			log.Print("refill to high level")
-			dw = dwhi
-			wt = hiwt
-		} else {
-			log.Print("minimum refill")
-			dw = dwlo
-			wt = lowt
-		}
+	dryout, wts, wto, fit := s.calculateDryoutAndWateringTime(index)
+
+	// the dryout model accounts for the climate itself
+	climate := s.climateFactor()
+	if m, ok := s.fitDryoutModel(index); ok {
+		l.Info("dryout model", "dryout", m.Dryout, "mean", dryout,
+			"coefficients", m.coefficients(), "rmse", m.RMSE, "samples", m.N)
+		dryout = m.Dryout
+		climate = 1
 	}
 
-	if save {
-		wateringTimeData.Offset = wto
-		wateringTimeData.Scale = wts
+	d := wateringDecision{
+		Plant:    index,
+		Time:     dt.Time,
+		Strategy: config.Strategy,
+		Weight:   weight,
+		Dryout:   dryout,
+		Climate:  climate,
+		Scale:    wts,
+		Offset:   wto,
+		LastW:    lastw,
+		DurW:     durw,
+	}
+
+	in := wateringInput{
+		time:     dt,
+		weight:   weight,
+		config:   config,
+		lastw:    lastw,
+		durw:     durw,
+		dryout:   dryout,
+		climate:  climate,
+		scale:    wts,
+		offset:   wto,
+		log:      l,
+		decision: &d,
+
+		nextHours: config.hoursToNextWindow(dt),
+	}
+	if w := config.windowAt(dt); w != nil {
+		in.window = *w
 	}
 
-	log.Printf("dryout: %v, wt scale: %v, wt offset: %v, delta weight: %v", dryout, wts, wto, dw)
-	log.Printf("watering time: %v", wt)
+	wt := config.strategy().water(&in)
+	d.Target = in.target()
+	d.Clamped = wt
 
-	if wt > 0 {
-		return clamp(wt, config.WaterStart, config.MaxWater)
+	l.Info("watering calculated", "strategy", config.Strategy,
+		"dryout", dryout, "scale", wts, "offset", wto, "ms", wt)
+
+	return wt, d, fit
+}
+
+// wateringDue reports whether the plant's strategy decides about watering
+// at the time.
+func (s *station) wateringDue(index int, dt decisionTime) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Config[index].strategy().due(&s.Config[index], dt)
+}
+
+// decisionTime returns the time of a watering decision of the hourly or
+// minute update.
+func (s *station) decisionTime(t time.Time, hourly bool) decisionTime {
+	if hourly {
+		t = t.Round(time.Hour)
+	} else {
+		t = t.Round(time.Minute)
 	}
-	return 0
+	return decisionTime{Time: t, hourly: hourly, loc: s.serverConfig().Location}
 }
 
 func clamp(v, min, max int) int {
@@ -614,13 +786,16 @@ func hourMedian(mindata []int) int {
 }
 
 func (s *station) update(hour int) {
+	c := s.serverConfig()
 	var err error
 	w := [2]int{}
 
 	if len(s.MinData.Weight[0]) == 0 || len(s.MinData.Weight[1]) == 0 {
-		w[0], w[1], err = s.wuc.ReadWeights()
+		w, err = s.readWeights()
+		s.health.wuc.record(err)
 		if err != nil {
-			log.Printf("failed to read weight: %v", err)
+			logger("wuc").Warn("failed to read weight", "hour", hour, "err", err)
+			fallbackCounter.WithLabelValues("weight").Inc()
 
 			// fallback to last read weight
 			for index := 0; index < 2; index++ {
@@ -632,15 +807,17 @@ func (s *station) update(hour int) {
 		}
 	} else {
 		for index := 0; index < 2; index++ {
-			w[index] = hourMedian(s.MinData.Weight[index])
+			w[index] = s.hourWeight(index)
 		}
 	}
 
 	var t, h int
 	if len(s.MinData.Humidity) == 0 || len(s.MinData.Temperature) == 0 {
 		tf, hf, err := s.sht.Sample()
+		s.health.sht.record(err)
 		if err != nil {
-			log.Printf("failed to read humidity and temperature: %v", err)
+			logger("sht").Warn("failed to read humidity and temperature", "hour", hour, "err", err)
+			fallbackCounter.WithLabelValues("climate").Inc()
 			// fallback to last read values
 			n := len(s.Data.Humidity)
 			if n > 0 {
@@ -659,44 +836,73 @@ func (s *station) update(hour int) {
 		t = hourMedian(s.MinData.Temperature)
 	}
 
+	for index := 0; index < 2; index++ {
+		s.verifyWatering(index, w[index])
+	}
+
 	// calculate watering time
+	dt := s.decisionTime(time.Now(), true)
 	wt := [2]int{}
 	for index := 0; index < 2; index++ {
-		if hour == s.Config[index].WaterHour {
-			wt[index] = s.calculateWatering(index, hour, w[index], true)
+		due := s.wateringDue(index, dt)
+		if due {
+			wt[index] = s.calculateWatering(index, dt, w[index], true)
 		}
 		if wt[index] > 0 {
-			wt[index] = s.wuc.DoWatering(index, wt[index])
+			wt[index] = s.waterAuto(index, wt[index], w[index])
+		}
+		if due {
+			s.completeDecision(index, wt[index])
 		}
 	}
 
 	if wt[0] > 0 {
-		s.publish(s.MQTT.Plant1Topic+"/water", byte(2), false, fmt.Sprint(wt[0]))
+		s.publish(c.MQTT.Plant1Topic+"/water", byte(2), false, fmt.Sprint(wt[0]))
 	}
 
 	if wt[1] > 0 {
-		s.publish(s.MQTT.Plant2Topic+"/water", byte(2), false, fmt.Sprint(wt[1]))
+		s.publish(c.MQTT.Plant2Topic+"/water", byte(2), false, fmt.Sprint(wt[1]))
+	}
+
+	var level [2]int
+	for i := range level {
+		level[i] = s.hourLevel(i)
 	}
 
 	// update values
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 	s.Data.Time = hour
 	const maxHours = backlogDays * 24
 	for i := range w {
 		s.Data.Weight[i] = pushSlice(s.Data.Weight[i], w[i], maxHours)
 		s.Data.Watering[i] = pushSlice(s.Data.Watering[i], wt[i], maxHours)
+		s.Data.Level[i] = pushSlice(s.Data.Level[i], level[i], maxHours)
 	}
 	s.Data.Humidity = pushSlice(s.Data.Humidity, h, maxHours)
 	s.Data.Temperature = pushSlice(s.Data.Temperature, t, maxHours)
+	s.Data.Count++
+	s.pruneEvents()
+	s.mutex.Unlock()
+
+	for i := range level {
+		s.checkReservoir(i)
+	}
 }
 
 func (s *station) updateMinute(min int) {
 	var err error
-	w := [2]int{}
-	w[0], w[1], err = s.wuc.ReadWeights()
+	m := minuteSample{
+		time:          time.Now(),
+		weightStatus:  sensorOK,
+		climateStatus: sensorOK,
+	}
+	m.weight, err = s.readWeights()
+	w := &m.weight
+	s.health.wuc.record(err)
 	if err != nil {
-		log.Printf("failed to read weight: %v", err)
+		logger("wuc").Warn("failed to read weight", "err", err)
+		m.weightStatus = sensorFallback
+		fallbackCounter.WithLabelValues("weight").Inc()
 		// fallback to last read weight
 		for i := 0; i < 2; i++ {
 			n := len(s.MinData.Weight[i])
@@ -707,8 +913,11 @@ func (s *station) updateMinute(min int) {
 	}
 
 	t, h, err := s.sht.Sample()
+	s.health.sht.record(err)
 	if err != nil {
-		log.Printf("failed to read humidity and temperature: %v", err)
+		logger("sht").Warn("failed to read humidity and temperature", "err", err)
+		m.climateStatus = sensorFallback
+		fallbackCounter.WithLabelValues("climate").Inc()
 		// fallback to last read values
 		n := len(s.MinData.Humidity)
 		if n > 0 {
@@ -719,21 +928,68 @@ func (s *station) updateMinute(min int) {
 			t = float32(s.MinData.Temperature[n-1]) / 100
 		}
 	}
+	m.temperature = t
+	m.humidity = h
+
+	for i := range w {
+		weightGauge.WithLabelValues(plantLabel(i)).Set(float64(w[i]))
+	}
+	temperatureGauge.Set(float64(t))
+	humidityGauge.Set(float64(h))
+
+	s.pollReservoir(&m)
 
 	// update values
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 	s.MinData.Time = min
 	for i := range w {
 		s.MinData.Weight[i] = pushSlice(s.MinData.Weight[i], w[i], backlogMinutes)
+		s.MinData.Level[i] = pushSlice(s.MinData.Level[i], m.limit[i], backlogMinutes)
 	}
 	s.MinData.Humidity = pushSlice(s.MinData.Humidity, int(h*100), backlogMinutes)
 	s.MinData.Temperature = pushSlice(s.MinData.Temperature, int(t*100), backlogMinutes)
+	s.MinData.Count++
+	s.mutex.Unlock()
+
+	s.publishMinute(&m)
+
+	s.expireModes()
+	s.waterScheduled(s.decisionTime(m.time, false))
+}
+
+// waterScheduled waters the plants with schedules due in the minute. The
+// watering time is added to the last hourly sample, whose successor shows
+// the weight gain.
+func (s *station) waterScheduled(dt decisionTime) {
+	c := s.serverConfig()
+	for index := 0; index < 2; index++ {
+		if !s.wateringDue(index, dt) {
+			continue
+		}
 
-	s.publish(s.MQTT.Plant1Topic+"/weight", byte(0), true, fmt.Sprint(w[0]))
-	s.publish(s.MQTT.Plant2Topic+"/weight", byte(0), true, fmt.Sprint(w[1]))
-	s.publish(s.MQTT.HumTempTopic+"/humidity", byte(0), true, fmt.Sprint(h))
-	s.publish(s.MQTT.HumTempTopic+"/temperature", byte(0), true, fmt.Sprint(t))
+		weight := s.hourWeight(index)
+		wt := s.calculateWatering(index, dt, weight, true)
+		if wt > 0 {
+			wt = s.waterAuto(index, wt, weight)
+		}
+		s.completeDecision(index, wt)
+		if wt <= 0 {
+			continue
+		}
+
+		s.mutex.Lock()
+		if n := len(s.Data.Watering[index]); n > 0 {
+			s.Data.Watering[index][n-1] += wt
+		}
+		s.watered[index] = s.MinData.Count
+		s.mutex.Unlock()
+
+		topic := c.MQTT.Plant1Topic
+		if index == 1 {
+			topic = c.MQTT.Plant2Topic
+		}
+		s.publish(topic+"/water", byte(2), false, fmt.Sprint(wt))
+	}
 }
 
 func dataHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
@@ -775,7 +1031,7 @@ func configHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 		index := getRequestIndex(r)
 		switch r.Method {
 		case http.MethodPut:
-			s.saveConfig(index, w, r.Body)
+			s.saveConfig(index, w, r)
 		case http.MethodGet:
 			s.sendConfig(index, w)
 		default:
@@ -784,36 +1040,51 @@ func configHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *station) saveConfig(index int, w http.ResponseWriter, r io.Reader) {
-	b, err := ioutil.ReadAll(r)
+func (s *station) saveConfig(index int, w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	c := s.Config
-	err = json.Unmarshal(b, &c[index])
+	s.mutex.Lock()
+	// decode into a copy so a rejected config leaves the slices untouched
+	c := s.Config[index].clone()
+	err = json.Unmarshal(b, &c)
+	if err == nil {
+		err = c.validate(s.serverConfig().Location)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
+		s.mutex.Unlock()
+		writeValidationError(w, err)
 		return
 	}
+	s.Config[index] = c
+	v := s.addConfigVersion(requestAuthor(r), "")
+	s.mutex.Unlock()
 
-	b, err = json.Marshal(c)
+	err = s.writePlantConfig()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
+	s.saveConfigHistory()
 
-	err = ioutil.WriteFile(s.serverConfig.Files.Config, b, 0600)
+	fmt.Fprintf(w, "config saved as version %v", v.Version)
+}
+
+// writePlantConfig saves the plant configuration.
+func (s *station) writePlantConfig() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.Config)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		return err
 	}
 
-	s.Config[index] = c[index]
-	fmt.Fprint(w, "config saved")
+	return ioutil.WriteFile(s.serverConfig().Files.Config, b, 0600)
 }
 
 func (s *station) sendConfig(index int, w http.ResponseWriter) {
@@ -838,7 +1109,7 @@ func wateringHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 		if !ok || len(tq) < 1 {
 			t, err := s.wuc.ReadLastWatering(index)
 			if err != nil {
-				log.Println("failed to read last watering time: ", err)
+				plantLogger("wuc", index).Warn("failed to read last watering time", "err", err)
 			}
 			fmt.Fprintf(w, "%v", t)
 			return
@@ -849,23 +1120,33 @@ func wateringHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		log.Printf("watering %v", t)
-		t = s.wuc.DoWatering(index, t)
-		log.Printf("watered %v", t)
+		plantLogger("http", index).Info("manual watering", "ms", t)
+		t, err = s.water(index, t, sourceHTTP)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		plantLogger("http", index).Info("manually watered", "ms", t)
 		fmt.Fprintf(w, "%v", t)
 	}
 }
 
 func weightHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w1, w2, err := s.wuc.ReadWeights()
+		var we [2]int
+		var err error
+		if r.URL.Query().Get("raw") != "" {
+			we[0], we[1], err = s.wuc.ReadWeights()
+		} else {
+			we, err = s.readWeights()
+		}
 		if err != nil {
-			log.Println("failed to read weights: ", err)
+			logger("wuc").Warn("failed to read weights", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 			return
 		}
-		fmt.Fprintf(w, "%v, %v", w1, w2)
+		fmt.Fprintf(w, "%v, %v", we[0], we[1])
 	}
 }
 
@@ -874,7 +1155,7 @@ func waterLimitHandler(s *station) func(w http.ResponseWriter, r *http.Request)
 		index := getRequestIndex(r)
 		m, err := s.wuc.ReadWateringLimit(index)
 		if err != nil {
-			log.Println("failed to read watering limit: ", err)
+			plantLogger("wuc", index).Warn("failed to read watering limit", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 			return
@@ -887,7 +1168,7 @@ func htHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		t, h, err := s.sht.Sample()
 		if err != nil {
-			log.Println("failed to read humidity and temperature: ", err)
+			logger("sht").Warn("failed to read humidity and temperature", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 			return
@@ -899,11 +1180,9 @@ func htHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 func calcWateringHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		index := getRequestIndex(r)
-		var err error
-		var we [2]int
-		we[0], we[1], err = s.wuc.ReadWeights()
+		_, err := s.readWeights()
 		if err != nil {
-			log.Println("failed to read weights: ", err)
+			logger("wuc").Warn("failed to read weights", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 			return
@@ -912,9 +1191,9 @@ func calcWateringHandler(s *station) func(w http.ResponseWriter, r *http.Request
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 
-		dryout, wts, wto := s.calculateDryoutAndWateringTime(index)
+		dryout, wts, wto, fit := s.calculateDryoutAndWateringTime(index)
 
-		fmt.Fprintf(w, "%v %v %v", dryout, wts, wto)
+		fmt.Fprintf(w, "%v %v %v %.0f %.0f", dryout, wts, wto, fit.ScaleCI, fit.OffsetCI)
 	}
 }
 
@@ -947,8 +1226,9 @@ func echoHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 
 func (s *station) secret() func(user, realm string) string {
 	return func(user, realm string) string {
-		if user == s.serverConfig.Login.User {
-			return s.serverConfig.Login.Pass
+		c := s.serverConfig()
+		if user == c.Login.User {
+			return c.Login.Pass
 		}
 		return ""
 	}
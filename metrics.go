@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	weightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plantstation_weight",
+		Help: "Current weight of the plant.",
+	}, []string{"plant"})
+	temperatureGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "plantstation_temperature_celsius",
+		Help: "Current temperature.",
+	})
+	humidityGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "plantstation_humidity_percent",
+		Help: "Current relative humidity.",
+	})
+	wateringCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plantstation_watering_milliseconds_total",
+		Help: "Total watering time per plant.",
+	}, []string{"plant"})
+	fallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plantstation_sensor_fallbacks_total",
+		Help: "Number of times the last value was used because a sensor could not be read.",
+	}, []string{"sensor"})
+	i2cErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plantstation_i2c_errors_total",
+		Help: "Number of failed I2C transactions by command.",
+	}, []string{"command"})
+	i2cDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "plantstation_i2c_duration_seconds",
+		Help:    "Latency of I2C transactions by command.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"command"})
+	mqttFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "plantstation_mqtt_publish_failures_total",
+		Help: "Number of failed MQTT publish attempts.",
+	})
+	httpRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plantstation_http_requests_total",
+		Help: "Number of HTTP requests by handler and status code.",
+	}, []string{"handler", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		weightGauge,
+		temperatureGauge,
+		humidityGauge,
+		wateringCounter,
+		fallbackCounter,
+		i2cErrorCounter,
+		i2cDuration,
+		mqttFailureCounter,
+		httpRequestCounter,
+	)
+}
+
+var cmdNames = map[byte]string{
+	cmdGetLastWatering: "cmdGetLastWatering",
+	cmdGetWaterLimit:   "cmdGetWaterLimit",
+	cmdGetWeight:       "cmdGetWeight",
+	cmdWatering:        "cmdWatering",
+	cmdEcho:            "cmdEcho",
+}
+
+// observeI2C records latency and outcome of a transaction with the Wuc.
+func observeI2C(cmd byte, start time.Time, err error) {
+	i2cDuration.WithLabelValues(cmdNames[cmd]).Observe(time.Since(start).Seconds())
+	if err != nil {
+		countI2CError(cmd)
+	}
+}
+
+func countI2CError(cmd byte) {
+	i2cErrorCounter.WithLabelValues(cmdNames[cmd]).Inc()
+}
+
+func plantLabel(index int) string {
+	return strconv.Itoa(index + 1)
+}
+
+// instrument counts requests to the handler by status code.
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return promhttp.InstrumentHandlerCounter(
+		httpRequestCounter.MustCurryWith(prometheus.Labels{"handler": name}), h)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// modeNormal waters as configured.
+	modeNormal = "normal"
+	// modePaused keeps measuring but never waters automatically.
+	modePaused = "paused"
+	// modeVacation raises the targets and spreads the reservoir over the
+	// days until the end of the vacation.
+	modeVacation = "vacation"
+)
+
+// A modeSetting is the operating mode of the station or of a single plant.
+type modeSetting struct {
+	Mode string `json:"mode"`
+	// Until is the optional end of the mode, afterwards normal mode applies.
+	Until *time.Time `json:"until,omitempty"`
+	// Raise is added to the levels in vacation mode, the level range by
+	// default.
+	Raise int `json:"raise,omitempty"`
+	// Reservoir is the watering time in ms the reservoir supplies during
+	// the vacation, zero for no limit.
+	Reservoir int `json:"reservoir,omitempty"`
+	// Used is the watering time spent in the mode.
+	Used int `json:"used"`
+	// Day and Today are the date and the watering time spent on it.
+	Day   string `json:"day,omitempty"`
+	Today int    `json:"today,omitempty"`
+}
+
+// stationModes are the station-wide mode, the plants' overrides and the
+// plants' lockouts after failed verifications.
+type stationModes struct {
+	Station  modeSetting     `json:"station"`
+	Plants   [2]*modeSetting `json:"plants"`
+	Lockouts [2]*lockout     `json:"lockouts"`
+}
+
+func (m *modeSetting) expired(t time.Time) bool {
+	return m.Until != nil && !t.Before(*m.Until)
+}
+
+func (m *modeSetting) name() string {
+	if m.Mode == "" {
+		return modeNormal
+	}
+	return m.Mode
+}
+
+func (m *modeSetting) validate() error {
+	switch m.name() {
+	case modeNormal, modePaused, modeVacation:
+	default:
+		return fmt.Errorf("invalid mode: %v", m.Mode)
+	}
+	if m.Raise < 0 || m.Reservoir < 0 {
+		return fmt.Errorf("raise and reservoir must not be negative")
+	}
+	return nil
+}
+
+// allowance returns the watering time available at t in vacation mode or
+// -1 for no limit. The rest of the reservoir is spread evenly over the
+// remaining days.
+func (m *modeSetting) allowance(t time.Time) int {
+	if m.Reservoir == 0 {
+		return -1
+	}
+
+	rest := m.Reservoir - m.Used
+	if rest <= 0 {
+		return 0
+	}
+	if m.Until == nil {
+		return rest
+	}
+
+	today := 0
+	if m.Day == t.Format("2006-01-02") {
+		today = m.Today
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	days := int(math.Ceil(m.Until.Sub(midnight).Hours() / 24))
+	if days < 1 {
+		days = 1
+	}
+
+	return clamp((rest+today)/days-today, 0, rest)
+}
+
+func (m *modeSetting) spend(t time.Time, ms int) {
+	day := t.Format("2006-01-02")
+	if m.Day != day {
+		m.Day = day
+		m.Today = 0
+	}
+	m.Today += ms
+	m.Used += ms
+}
+
+// plantMode returns the mode in effect for the plant. The caller must hold
+// the mutex.
+func (s *station) plantMode(index int, t time.Time) *modeSetting {
+	if p := s.Modes.Plants[index]; p != nil && !p.expired(t) {
+		return p
+	}
+	if !s.Modes.Station.expired(t) {
+		return &s.Modes.Station
+	}
+	return &modeSetting{Mode: modeNormal}
+}
+
+// modeConfig returns the plant's configuration adjusted to its mode. The
+// caller must hold the mutex.
+func (s *station) modeConfig(index int) plantConfig {
+	c := s.Config[index]
+	m := s.plantMode(index, time.Now())
+	if m.name() != modeVacation {
+		return c
+	}
+
+	raise := m.Raise
+	if raise == 0 {
+		raise = c.LevelRange
+	}
+	c.LowLevel += raise
+	c.HighLevel += raise
+
+	c.Windows = append([]wateringWindow(nil), c.Windows...)
+	for i := range c.Windows {
+		if c.Windows[i].Target > 0 {
+			c.Windows[i].Target += raise
+		}
+	}
+	return c
+}
+
+// waterAuto waters the plant at the given weight automatically as far as
+// its mode and lockout permit and returns the watering time.
+func (s *station) waterAuto(index, ms, weight int) int {
+	l := plantLogger("mode", index)
+	now := time.Now()
+
+	s.mutex.RLock()
+	m := *s.plantMode(index, now)
+	lo := s.Modes.Lockouts[index]
+	s.mutex.RUnlock()
+
+	if lo != nil {
+		l.Warn("locked out, skipping watering", "kind", lo.Kind, "ms", ms)
+		return 0
+	}
+
+	switch m.name() {
+	case modePaused:
+		l.Info("paused, skipping watering", "ms", ms)
+		return 0
+	case modeVacation:
+		if a := m.allowance(now); a >= 0 && ms > a {
+			l.Info("vacation budget exceeded", "ms", ms, "allowance", a)
+			ms = a
+		}
+	}
+
+	if ms = s.reservoirLimit(index, ms); ms <= 0 {
+		return 0
+	}
+
+	ms, err := s.water(index, ms, sourceScheduler)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	s.expectVerification(index, ms, weight)
+
+	if m.name() == modeVacation {
+		s.mutex.Lock()
+		s.plantMode(index, now).spend(now, ms)
+		s.mutex.Unlock()
+		s.saveModes()
+	}
+
+	return ms
+}
+
+// expireModes returns to normal mode after the end of a mode.
+func (s *station) expireModes() {
+	now := time.Now()
+	changed := false
+
+	s.mutex.Lock()
+	if s.Modes.Station.expired(now) {
+		logger("mode").Info("mode ended", "mode", s.Modes.Station.name())
+		s.Modes.Station = modeSetting{Mode: modeNormal}
+		changed = true
+	}
+	for i, p := range s.Modes.Plants {
+		if p != nil && p.expired(now) {
+			plantLogger("mode", i).Info("mode ended", "mode", p.name())
+			s.Modes.Plants[i] = nil
+			changed = true
+		}
+	}
+	s.mutex.Unlock()
+
+	if changed {
+		s.saveModes()
+		s.publishModes()
+	}
+}
+
+// sameSetting reports whether two settings differ only in the spent
+// watering time.
+func sameSetting(a, b *modeSetting) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if (a.Until == nil) != (b.Until == nil) ||
+		a.Until != nil && !a.Until.Equal(*b.Until) {
+		return false
+	}
+	return a.Mode == b.Mode && a.Raise == b.Raise && a.Reservoir == b.Reservoir
+}
+
+// setMode replaces the station-wide mode if index is negative, otherwise
+// the plant's override. A nil setting removes the override. The spent
+// watering time is kept if the setting equals the current one.
+func (s *station) setMode(index int, m *modeSetting) error {
+	if m != nil {
+		if err := m.validate(); err != nil {
+			return err
+		}
+		m.Used, m.Day, m.Today = 0, "", 0
+	}
+
+	s.mutex.Lock()
+	cur := &s.Modes.Station
+	if index >= 0 {
+		cur = s.Modes.Plants[index]
+	}
+	if m != nil && sameSetting(cur, m) {
+		m.Used, m.Day, m.Today = cur.Used, cur.Day, cur.Today
+	}
+	if index < 0 {
+		if m == nil {
+			m = &modeSetting{Mode: modeNormal}
+		}
+		s.Modes.Station = *m
+	} else {
+		s.Modes.Plants[index] = m
+	}
+	s.mutex.Unlock()
+
+	l := logger("mode")
+	if index >= 0 {
+		l = plantLogger("mode", index)
+	}
+	if m != nil {
+		l.Info("mode set", "mode", m.name(), "until", m.Until)
+	} else {
+		l.Info("mode override removed")
+	}
+
+	s.saveModes()
+	s.publishModes()
+	return nil
+}
+
+func (s *station) readModes() {
+	c := s.serverConfig()
+	b, err := ioutil.ReadFile(c.Files.Mode)
+	if err != nil && os.IsNotExist(err) {
+		logger("storage").Info("no mode found, using normal mode",
+			"file", c.Files.Mode)
+		return
+	} else if err != nil {
+		log.Fatalf("failed to read mode from %s: %v",
+			c.Files.Mode, err)
+	}
+
+	err = json.Unmarshal(b, &s.Modes)
+	if err != nil {
+		log.Fatalf("failed to parse mode: %v", err)
+	}
+}
+
+func (s *station) saveModes() {
+	c := s.serverConfig()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.Modes)
+	if err != nil {
+		log.Fatalf("failed to marshal mode: %v", err)
+	}
+
+	err = ioutil.WriteFile(c.Files.Mode, b, 0600)
+	if err != nil {
+		log.Fatalf("failed to save mode to %s: %v",
+			c.Files.Mode, err)
+	}
+}
+
+// publishModes publishes the station-wide mode and the mode in effect for
+// each plant as retained messages.
+func (s *station) publishModes() {
+	c := s.serverConfig()
+	now := time.Now()
+
+	s.mutex.RLock()
+	station := s.Modes.Station
+	var plants [2]string
+	for i := range plants {
+		plants[i] = s.plantMode(i, now).name()
+	}
+	s.mutex.RUnlock()
+
+	if c.MQTT.ModeTopic != "" {
+		if b, err := json.Marshal(station); err == nil {
+			s.publish(c.MQTT.ModeTopic, byte(1), true, string(b))
+		}
+	}
+	s.publish(c.MQTT.Plant1Topic+"/mode", byte(1), true, plants[0])
+	s.publish(c.MQTT.Plant2Topic+"/mode", byte(1), true, plants[1])
+}
+
+// parseModeSetting accepts a JSON mode setting or a bare mode name.
+func parseModeSetting(b []byte) (*modeSetting, error) {
+	m := &modeSetting{}
+	text := strings.TrimSpace(string(b))
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+	} else {
+		m.Mode = text
+	}
+	return m, m.validate()
+}
+
+// subscribeModes lets the mode be set by MQTT on <ModeTopic>/set for the
+// station and <PlantTopic>/mode/set for each plant. Retained settings are
+// ignored, so a mode ended or changed since is not set again on reconnect.
+func (s *station) subscribeModes() {
+	handler := func(index int) MQTT.MessageHandler {
+		return func(c MQTT.Client, msg MQTT.Message) {
+			if msg.Retained() {
+				logger("mqtt").Warn("ignoring retained mode", "topic", msg.Topic())
+				return
+			}
+			m, err := parseModeSetting(msg.Payload())
+			if err == nil {
+				err = s.setMode(index, m)
+			}
+			if err != nil {
+				logger("mqtt").Warn("invalid mode", "topic", msg.Topic(), "err", err)
+			}
+		}
+	}
+
+	conf := s.serverConfig()
+	if conf.MQTT.ModeTopic != "" {
+		s.mqtt.subscribe(conf.MQTT.ModeTopic+"/set", handler(-1))
+	}
+	s.mqtt.subscribe(conf.MQTT.Plant1Topic+"/mode/set", handler(0))
+	s.mqtt.subscribe(conf.MQTT.Plant2Topic+"/mode/set", handler(1))
+}
+
+type modeStatus struct {
+	stationModes
+	Effective [2]string `json:"effective"`
+}
+
+// modeHandler shows the modes on GET. PUT sets the mode given as JSON or
+// bare name in the body, of the plant if parameter i is given, otherwise of
+// the station. DELETE with parameter i removes the plant's override.
+func modeHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		index := -1
+		if _, ok := r.URL.Query()["i"]; ok {
+			index = getRequestIndex(r)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			m, err := parseModeSetting(b)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = s.setMode(index, m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			if index < 0 {
+				http.Error(w, "parameter i missing", http.StatusBadRequest)
+				return
+			}
+			s.setMode(index, nil)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		now := time.Now()
+		s.mutex.RLock()
+		status := modeStatus{stationModes: s.Modes}
+		for i := range status.Effective {
+			status.Effective[i] = s.plantMode(i, now).name()
+		}
+		js, err := json.Marshal(status)
+		s.mutex.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
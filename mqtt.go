@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttTimeout          = 10 * time.Second
+	mqttMinBackoff       = time.Second
+	mqttMaxBackoff       = 5 * time.Minute
+	mqttDefaultQueueSize = 1000
+	// mqttSaveInterval is the interval of writing a changed queue to disk
+	mqttSaveInterval = 5 * time.Minute
+)
+
+type mqttMessage struct {
+	Topic    string `json:"topic"`
+	Qos      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+	Payload  string `json:"payload"`
+}
+
+// A mqttPublisher publishes messages to the MQTT broker from its own
+// goroutine. Messages which cannot be delivered are kept in a bounded queue
+// and are sent as soon as the connection is back. The queue is written to
+// disk periodically and on close, not on every change, to spare the SD card.
+type mqttPublisher struct {
+	client    MQTT.Client
+	config    mqttConfig
+	queueFile string
+
+	messages  chan mqttMessage
+	connected chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+
+	mutex sync.Mutex
+	queue []mqttMessage
+	// dropped counts the messages dropped from the front of the full queue
+	dropped int
+	// changed is set when the queue differs from the file
+	changed bool
+	// queueLen is the length of the queue, readable without the mutex
+	queueLen atomic.Int64
+
+	subscriptions map[string]MQTT.MessageHandler
+}
+
+func newMQTTPublisher(config mqttConfig, queueFile string) (*mqttPublisher, error) {
+	p := &mqttPublisher{
+		config:    config,
+		queueFile: queueFile,
+		messages:  make(chan mqttMessage, 64),
+		connected: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+
+		subscriptions: make(map[string]MQTT.MessageHandler),
+	}
+
+	if p.config.QueueSize <= 0 {
+		p.config.QueueSize = mqttDefaultQueueSize
+	}
+
+	connOpts := MQTT.NewClientOptions().AddBroker(config.Server)
+	connOpts.SetClientID(config.ClientID)
+	connOpts.SetUsername(config.User)
+	connOpts.SetPassword(config.Pass)
+	connOpts.SetConnectTimeout(mqttTimeout)
+	// paho doubles the reconnect interval up to this maximum
+	connOpts.SetAutoReconnect(true)
+	connOpts.SetMaxReconnectInterval(mqttMaxBackoff)
+	connOpts.SetOnConnectHandler(p.onConnect)
+	connOpts.SetConnectionLostHandler(func(c MQTT.Client, err error) {
+		logger("mqtt").Warn("lost connection to broker", "err", err)
+	})
+
+	if config.StatusTopic != "" {
+		connOpts.SetWill(config.StatusTopic, "offline", 1, true)
+	}
+
+	if config.CACert != "" || config.ClientCert != "" {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		connOpts.SetTLSConfig(tlsConfig)
+	}
+
+	p.client = MQTT.NewClient(connOpts)
+	p.readQueue()
+
+	return p, nil
+}
+
+func (c *mqttConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if c.CACert != "" {
+		b, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", c.CACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// publish hands a message to the publisher goroutine without blocking.
+func (p *mqttPublisher) publish(topic string, qos byte, retained bool, payload string) {
+	m := mqttMessage{
+		Topic:    topic,
+		Qos:      qos,
+		Retained: retained,
+		Payload:  payload,
+	}
+
+	select {
+	case p.messages <- m:
+	default:
+		logger("mqtt").Warn("publisher busy, queueing message", "topic", topic)
+		p.enqueue(m)
+	}
+}
+
+func (p *mqttPublisher) run() {
+	defer close(p.stopped)
+
+	go p.connect()
+
+	save := time.NewTicker(mqttSaveInterval)
+	defer save.Stop()
+
+	for {
+		select {
+		case m := <-p.messages:
+			// keep order, queued messages go first
+			if p.client.IsConnectionOpen() && p.flush() && p.send(m) {
+				continue
+			}
+			p.enqueue(m)
+		case <-p.connected:
+			p.flush()
+		case <-save.C:
+			p.mutex.Lock()
+			if p.changed {
+				p.saveQueue()
+			}
+			p.mutex.Unlock()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// connect tries to establish the initial connection with exponential backoff.
+// Once connected, reconnects are handled by the client.
+func (p *mqttPublisher) connect() {
+	backoff := mqttMinBackoff
+	for {
+		logger("mqtt").Info("connecting to broker")
+		token := p.client.Connect()
+		if !token.WaitTimeout(mqttTimeout) {
+			logger("mqtt").Warn("timeout while connecting to broker", "retry", backoff)
+		} else if err := token.Error(); err != nil {
+			logger("mqtt").Warn("failed to connect to broker", "err", err, "retry", backoff)
+		} else {
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-p.done:
+			return
+		}
+
+		backoff *= 2
+		if backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+func (p *mqttPublisher) onConnect(c MQTT.Client) {
+	logger("mqtt").Info("connected to broker")
+	if p.config.StatusTopic != "" {
+		c.Publish(p.config.StatusTopic, 1, true, "online")
+	}
+
+	// subscriptions do not survive a new session
+	p.mutex.Lock()
+	for topic, handler := range p.subscriptions {
+		c.Subscribe(topic, 1, handler)
+	}
+	p.mutex.Unlock()
+
+	select {
+	case p.connected <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe calls the handler for messages on the topic while connected.
+func (p *mqttPublisher) subscribe(topic string, handler MQTT.MessageHandler) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.subscriptions[topic] = handler
+	if p.client.IsConnectionOpen() {
+		p.client.Subscribe(topic, 1, handler)
+	}
+}
+
+func (p *mqttPublisher) send(m mqttMessage) bool {
+	token := p.client.Publish(m.Topic, m.Qos, m.Retained, m.Payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		logger("mqtt").Warn("timeout while publishing", "topic", m.Topic)
+		mqttFailureCounter.Inc()
+		return false
+	}
+	if err := token.Error(); err != nil {
+		logger("mqtt").Warn("failed to publish", "topic", m.Topic, "err", err)
+		mqttFailureCounter.Inc()
+		return false
+	}
+	return true
+}
+
+func (p *mqttPublisher) enqueue(m mqttMessage) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := len(p.queue) + 1
+	if n > p.config.QueueSize {
+		logger("mqtt").Warn("queue full, dropping messages", "count", n-p.config.QueueSize)
+		p.queue = append(p.queue[:0], p.queue[n-p.config.QueueSize:]...)
+		p.dropped += n - p.config.QueueSize
+	}
+	p.queue = append(p.queue, m)
+	p.changed = true
+	p.queueLen.Store(int64(len(p.queue)))
+}
+
+// flush sends queued messages in order until the queue is empty or sending
+// fails. It returns whether the queue is empty. The mutex is not held while
+// sending, so messages can be queued meanwhile.
+func (p *mqttPublisher) flush() bool {
+	p.mutex.Lock()
+	pending := append([]mqttMessage(nil), p.queue...)
+	dropped := p.dropped
+	p.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return true
+	}
+
+	logger("mqtt").Info("sending queued messages", "count", len(pending))
+
+	sent := 0
+	for _, m := range pending {
+		if !p.send(m) {
+			break
+		}
+		sent++
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// messages dropped while sending were taken from the sent ones
+	if n := sent - (p.dropped - dropped); n > 0 {
+		p.queue = append(p.queue[:0], p.queue[n:]...)
+	}
+	if sent > 0 {
+		p.changed = true
+	}
+	p.queueLen.Store(int64(len(p.queue)))
+	if len(p.queue) == 0 {
+		// an empty queue is removed right away so that sent messages are
+		// not sent again after a restart
+		p.saveQueue()
+	}
+
+	return len(p.queue) == 0
+}
+
+func (p *mqttPublisher) queued() int {
+	return int(p.queueLen.Load())
+}
+
+func (p *mqttPublisher) readQueue() {
+	if p.queueFile == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(p.queueFile)
+	if err != nil && os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger("mqtt").Error("failed to read queue", "file", p.queueFile, "err", err)
+		return
+	}
+
+	if err = json.Unmarshal(b, &p.queue); err != nil {
+		logger("mqtt").Error("failed to parse queue", "err", err)
+		p.queue = nil
+	}
+
+	if len(p.queue) > p.config.QueueSize {
+		p.queue = p.queue[len(p.queue)-p.config.QueueSize:]
+	}
+	p.queueLen.Store(int64(len(p.queue)))
+}
+
+// saveQueue writes the queue to disk, the caller must hold the mutex.
+func (p *mqttPublisher) saveQueue() {
+	p.changed = false
+
+	if p.queueFile == "" {
+		return
+	}
+
+	if len(p.queue) == 0 {
+		if err := os.Remove(p.queueFile); err != nil && !os.IsNotExist(err) {
+			logger("mqtt").Error("failed to remove queue", "file", p.queueFile, "err", err)
+		}
+		return
+	}
+
+	b, err := json.Marshal(p.queue)
+	if err != nil {
+		logger("mqtt").Error("failed to marshal queue", "err", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(p.queueFile, b, 0600); err != nil {
+		logger("mqtt").Error("failed to save queue", "file", p.queueFile, "err", err)
+	}
+}
+
+// close stops the publisher, queues pending messages and announces the
+// station as offline.
+func (p *mqttPublisher) close() {
+	close(p.done)
+	<-p.stopped
+
+	for len(p.messages) > 0 {
+		p.enqueue(<-p.messages)
+	}
+
+	p.mutex.Lock()
+	if p.changed {
+		p.saveQueue()
+	}
+	p.mutex.Unlock()
+
+	if p.client.IsConnected() {
+		if p.config.StatusTopic != "" {
+			p.client.Publish(p.config.StatusTopic, 1, true, "offline").WaitTimeout(mqttTimeout)
+		}
+		p.client.Disconnect(250)
+	}
+}
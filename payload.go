@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	payloadValue = "value"
+	payloadJSON  = "json"
+)
+
+const (
+	sensorOK       = "ok"
+	sensorFallback = "fallback"
+)
+
+type measurement struct {
+	Value interface{} `json:"value"`
+	Unit  string      `json:"unit,omitempty"`
+}
+
+// plantState is the JSON document published per plant every minute.
+type plantState struct {
+	Time       time.Time   `json:"time"`
+	Weight     measurement `json:"weight"`
+	Status     string      `json:"status"`
+	WaterLimit measurement `json:"waterlimit"`
+	LimitState string      `json:"limitstatus"`
+}
+
+// climateState is the JSON document published for the climate sensor every minute.
+type climateState struct {
+	Time        time.Time   `json:"time"`
+	Temperature measurement `json:"temperature"`
+	Humidity    measurement `json:"humidity"`
+	Status      string      `json:"status"`
+}
+
+// minuteSample holds the values read in one minute update.
+type minuteSample struct {
+	time          time.Time
+	weight        [2]int
+	weightStatus  string
+	temperature   float32
+	humidity      float32
+	climateStatus string
+	limit         [2]int
+	limitStatus   [2]string
+}
+
+func (s *station) weightUnit(index int) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.Calibration[index].calibrated() {
+		return "g"
+	}
+	return "counts"
+}
+
+func (s *station) publishJSON(topic string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger("mqtt").Error("failed to marshal payload", "topic", topic, "err", err)
+		return
+	}
+	s.publish(topic, byte(0), true, string(b))
+}
+
+func (s *station) publishMinute(m *minuteSample) {
+	c := s.serverConfig()
+	s.publish(c.MQTT.Plant1Topic+"/weight", byte(0), true, fmt.Sprint(m.weight[0]))
+	s.publish(c.MQTT.Plant2Topic+"/weight", byte(0), true, fmt.Sprint(m.weight[1]))
+	s.publish(c.MQTT.HumTempTopic+"/humidity", byte(0), true, fmt.Sprint(m.humidity))
+	s.publish(c.MQTT.HumTempTopic+"/temperature", byte(0), true, fmt.Sprint(m.temperature))
+
+	if c.MQTT.Payload != payloadJSON {
+		return
+	}
+
+	topics := [2]string{c.MQTT.Plant1Topic, c.MQTT.Plant2Topic}
+	for i, topic := range topics {
+		s.publishJSON(topic+"/state", plantState{
+			Time:       m.time,
+			Weight:     measurement{Value: m.weight[i], Unit: s.weightUnit(i)},
+			Status:     m.weightStatus,
+			WaterLimit: measurement{Value: m.limit[i]},
+			LimitState: m.limitStatus[i],
+		})
+	}
+
+	s.publishJSON(c.MQTT.HumTempTopic+"/state", climateState{
+		Time:        m.time,
+		Temperature: measurement{Value: m.temperature, Unit: "°C"},
+		Humidity:    measurement{Value: m.humidity, Unit: "%"},
+		Status:      m.climateStatus,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// modelHalfLife is the age in hours at which a watering counts half
+	modelHalfLife = 7 * 24
+	// confidenceZ is the normal quantile of the 95% confidence intervals
+	confidenceZ = 1.96
+)
+
+// A weightedPoint relates a weight gain x to a watering time y.
+type weightedPoint struct {
+	x, y, w float64
+}
+
+// A lineFit is the line y = Scale*x + Offset with 95% confidence intervals.
+type lineFit struct {
+	Scale    float64    `json:"scale"`
+	Offset   float64    `json:"offset"`
+	ScaleCI  [2]float64 `json:"scaleci"`
+	OffsetCI [2]float64 `json:"offsetci"`
+	N        int        `json:"n"`
+}
+
+// decay returns the weight of a sample of the given age in hours.
+func decay(age int) float64 {
+	return math.Pow(0.5, float64(age)/modelHalfLife)
+}
+
+type weightedValue struct {
+	v, w float64
+}
+
+// weightedQuantile returns the value below which the fraction q of the
+// total weight lies. The values are sorted in place.
+func weightedQuantile(values []weightedValue, q float64) float64 {
+	sort.Slice(values, func(i, j int) bool { return values[i].v < values[j].v })
+
+	total := 0.0
+	for _, v := range values {
+		total += v.w
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v.w
+		if sum >= q*total {
+			return v.v
+		}
+	}
+	return values[len(values)-1].v
+}
+
+// intercepts returns the weighted residuals y - slope*x.
+func intercepts(points []weightedPoint, slope float64) []weightedValue {
+	res := make([]weightedValue, len(points))
+	for i, p := range points {
+		res[i] = weightedValue{p.y - slope*p.x, p.w}
+	}
+	return res
+}
+
+// theilSen fits a line by the weighted median of the pairwise slopes, which
+// is insensitive to outliers. A pair is weighted by the product of its
+// points' weights. The confidence interval of the slope follows Sen's
+// method from the variance of Kendall's tau.
+func theilSen(points []weightedPoint) (fit lineFit, ok bool) {
+	n := len(points)
+	var slopes []weightedValue
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			dx := points[j].x - points[i].x
+			if dx == 0 {
+				continue
+			}
+			slopes = append(slopes, weightedValue{
+				(points[j].y - points[i].y) / dx,
+				points[i].w * points[j].w,
+			})
+		}
+	}
+
+	m := float64(len(slopes))
+	if m == 0 {
+		return fit, false
+	}
+
+	fit.N = n
+	fit.Scale = weightedQuantile(slopes, 0.5)
+	fit.Offset = weightedQuantile(intercepts(points, fit.Scale), 0.5)
+
+	fn := float64(n)
+	c := confidenceZ * math.Sqrt(fn*(fn-1)*(2*fn+5)/18)
+	lo := math.Max(0, (m-c)/(2*m))
+	hi := math.Min(1, (m+c)/(2*m))
+	fit.ScaleCI = [2]float64{weightedQuantile(slopes, lo), weightedQuantile(slopes, hi)}
+
+	// the offset varies against the slope
+	o1 := weightedQuantile(intercepts(points, fit.ScaleCI[1]), 0.5)
+	o2 := weightedQuantile(intercepts(points, fit.ScaleCI[0]), 0.5)
+	fit.OffsetCI = [2]float64{math.Min(o1, o2), math.Max(o1, o2)}
+
+	return fit, true
+}
+
+// originFit fits a line through the origin by the weighted median of the
+// ratios y/x of the points with positive x.
+func originFit(points []weightedPoint) (fit lineFit, ok bool) {
+	var ratios []weightedValue
+	for _, p := range points {
+		if p.x > 0 {
+			ratios = append(ratios, weightedValue{p.y / p.x, p.w})
+		}
+	}
+	if len(ratios) == 0 {
+		return fit, false
+	}
+
+	fit.N = len(ratios)
+	fit.Scale = weightedQuantile(ratios, 0.5)
+
+	fn := float64(len(ratios))
+	c := confidenceZ * math.Sqrt(fn) / 2
+	lo := math.Max(0, (fn/2-c)/fn)
+	hi := math.Min(1, (fn/2+c)/fn)
+	fit.ScaleCI = [2]float64{weightedQuantile(ratios, lo), weightedQuantile(ratios, hi)}
+
+	return fit, true
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Synthetic hourly weights and waterings in ms of a plant over three days,
+// watered at 40 ms per g after an offset of 1500 ms with a dryout of 3 to
+// 6 g per hour. The watering at hour 44 ran off and gained almost nothing.
+var (
+	syntheticWeights = []int{
+		1480, 1476, 1472, 1467, 1461, 1458, 1455, 1450, 1447, 1543, 1538, 1535,
+		1530, 1526, 1523, 1520, 1515, 1510, 1507, 1503, 1500, 1615, 1610, 1607,
+		1602, 1599, 1595, 1589, 1583, 1578, 1575, 1570, 1565, 1640, 1637, 1633,
+		1630, 1625, 1621, 1617, 1612, 1608, 1603, 1600, 1595, 1593, 1588, 1582,
+		1578, 1575, 1570, 1565, 1559, 1555, 1551, 1548, 1543, 1647, 1644, 1639,
+		1636, 1631, 1627, 1622, 1616, 1611, 1606, 1737, 1732, 1727, 1722, 1718,
+	}
+	syntheticWaterings = []int{
+		0, 0, 0, 0, 0, 0, 0, 0, 5500, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 6300, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 4700, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 7500, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 5900, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 6900, 0, 0, 0, 0, 0,
+	}
+
+	// synthetic short waterings of a plant gaining more than the watering
+	// time suggests, 50 ms per g with an offset of -800 ms, which fits a
+	// negative offset
+	shortWeights = []int{
+		1480, 1476, 1472, 1468, 1462, 1458, 1455, 1450, 1446, 1501, 1496, 1492,
+		1486, 1481, 1477, 1472, 1469, 1466, 1461, 1456, 1452, 1524, 1520, 1515,
+		1510, 1507, 1501, 1498, 1493, 1488, 1484, 1480, 1474, 1538, 1533, 1528,
+		1523, 1518, 1515, 1512, 1508, 1503, 1497, 1491, 1488, 1569, 1563, 1557,
+		1553, 1547, 1542, 1536, 1531, 1527, 1521, 1516, 1510, 1562, 1559, 1554,
+		1550, 1546, 1541, 1538, 1533, 1530, 1526, 1594, 1590, 1584, 1580, 1575,
+	}
+	shortWaterings = []int{
+		0, 0, 0, 0, 0, 0, 0, 0, 2200, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 3000, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 2600, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 3400, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 2000, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 2800, 0, 0, 0, 0, 0,
+	}
+)
+
+// wateringPoints returns the weight gains and watering times of a series
+// with equal weights.
+func wateringPoints(weights, waterings []int) []weightedPoint {
+	var points []weightedPoint
+	for i := 1; i < len(weights); i++ {
+		if waterings[i-1] > 0 {
+			points = append(points, weightedPoint{
+				x: float64(weights[i] - weights[i-1]),
+				y: float64(waterings[i-1]),
+				w: 1,
+			})
+		}
+	}
+	return points
+}
+
+func seriesStation(weights, waterings []int) *station {
+	s := &station{}
+	s.Data.Weight[0] = weights
+	s.Data.Watering[0] = waterings
+	s.Data.Count = len(weights)
+	return s
+}
+
+func between(t *testing.T, name string, v, min, max float64) {
+	t.Helper()
+	if v < min || v > max {
+		t.Errorf("%v = %v, want between %v and %v", name, v, min, max)
+	}
+}
+
+func TestTheilSenIgnoresOutlier(t *testing.T) {
+	fit, ok := theilSen(wateringPoints(syntheticWeights, syntheticWaterings))
+	if !ok {
+		t.Fatal("no fit")
+	}
+	if fit.N != 6 {
+		t.Errorf("N = %v, want 6", fit.N)
+	}
+	between(t, "Scale", fit.Scale, 36, 44)
+	between(t, "Offset", fit.Offset, 1500, 2100)
+	between(t, "Scale", fit.Scale, fit.ScaleCI[0], fit.ScaleCI[1])
+	between(t, "Offset", fit.Offset, fit.OffsetCI[0], fit.OffsetCI[1])
+}
+
+func TestTheilSenNeedsDifferentGains(t *testing.T) {
+	points := []weightedPoint{{50, 3000, 1}, {50, 3500, 1}, {50, 2500, 1}}
+	if _, ok := theilSen(points); ok {
+		t.Error("fit of equal gains")
+	}
+	if _, ok := theilSen(nil); ok {
+		t.Error("fit without points")
+	}
+}
+
+func TestTheilSenWeights(t *testing.T) {
+	// the recent waterings follow another line than the old ones
+	points := []weightedPoint{
+		{40, 2000, decay(200)}, {80, 4000, decay(190)}, {120, 6000, decay(180)},
+		{40, 3000, decay(3)}, {80, 5000, decay(2)}, {120, 7000, decay(1)},
+	}
+	fit, ok := theilSen(points)
+	if !ok {
+		t.Fatal("no fit")
+	}
+	between(t, "Scale", fit.Scale, 49, 51)
+	between(t, "Offset", fit.Offset, 900, 1100)
+}
+
+func TestOriginFit(t *testing.T) {
+	points := wateringPoints(shortWeights, shortWaterings)
+	points = append(points, weightedPoint{0, 1000, 1}, weightedPoint{-5, 1000, 1})
+
+	fit, ok := originFit(points)
+	if !ok {
+		t.Fatal("no fit")
+	}
+	if fit.N != 6 {
+		t.Errorf("N = %v, want 6 without the points of no gain", fit.N)
+	}
+	if fit.Offset != 0 {
+		t.Errorf("Offset = %v, want 0", fit.Offset)
+	}
+	between(t, "Scale", fit.Scale, 38, 43)
+	between(t, "Scale", fit.Scale, fit.ScaleCI[0], fit.ScaleCI[1])
+
+	if _, ok := originFit([]weightedPoint{{0, 1000, 1}, {-5, 1000, 1}}); ok {
+		t.Error("fit without gains")
+	}
+}
+
+func TestCalculateDryoutAndWateringTime(t *testing.T) {
+	s := seriesStation(syntheticWeights, syntheticWaterings)
+	dryout, scale, offset, fit := s.calculateDryoutAndWateringTime(0)
+
+	between(t, "dryout", float64(dryout), 100, 120)
+	between(t, "scale", float64(scale), 36, 44)
+	between(t, "offset", float64(offset), 1500, 2100)
+	if fit.N != 6 {
+		t.Errorf("fit.N = %v, want 6", fit.N)
+	}
+	if scale != int(math.Round(fit.Scale)) || offset != int(math.Round(fit.Offset)) {
+		t.Errorf("scale %v and offset %v differ from fit %+v", scale, offset, fit)
+	}
+}
+
+func TestCalculateNegativeOffset(t *testing.T) {
+	points := wateringPoints(shortWeights, shortWaterings)
+	if fit, _ := theilSen(points); fit.Offset >= 0 {
+		t.Fatalf("series fits offset %v, want negative", fit.Offset)
+	}
+
+	s := seriesStation(shortWeights, shortWaterings)
+	_, scale, offset, fit := s.calculateDryoutAndWateringTime(0)
+	if offset != 0 {
+		t.Errorf("offset = %v, want 0", offset)
+	}
+	between(t, "scale", float64(scale), 38, 43)
+	if fit.Offset != 0 || fit.N != 6 {
+		t.Errorf("fit = %+v, want the fit through the origin", fit)
+	}
+}
+
+func TestCalculateBaselineChange(t *testing.T) {
+	s := seriesStation(syntheticWeights, syntheticWaterings)
+	// the plant was replaced during the watering at hour 20
+	s.Data.Events = []plantEvent{{Plant: 0, Sample: 21, Kind: eventReplant}}
+
+	_, _, _, fit := s.calculateDryoutAndWateringTime(0)
+	if fit.N != 5 {
+		t.Errorf("fit.N = %v, want 5 without the watering across the change", fit.N)
+	}
+}
+
+func TestCalculateFallback(t *testing.T) {
+	s := seriesStation(syntheticWeights, make([]int, len(syntheticWeights)))
+	s.WateringTimeData[0] = wateringTimeData{Scale: 45, Offset: 1200}
+
+	dryout, scale, offset, fit := s.calculateDryoutAndWateringTime(0)
+	if scale != 45 || offset != 1200 {
+		t.Errorf("scale, offset = %v, %v, want the stored 45, 1200", scale, offset)
+	}
+	if fit.N != 0 {
+		t.Errorf("fit = %+v, want none", fit)
+	}
+	between(t, "dryout", float64(dryout), 100, 120)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout is the time given to requests of a replaced listener
+const shutdownTimeout = 10 * time.Second
+
+// validate checks the server configuration and returns the errors of all
+// invalid fields or nil.
+func (c *serverConfig) validate() error {
+	v := &validator{}
+
+	if _, _, err := net.SplitHostPort(c.HTTPS.Addr); err != nil {
+		v.fail("HTTPS.Addr", "%v", err)
+	}
+	if _, err := tls.LoadX509KeyPair(c.HTTPS.Cert, c.HTTPS.Key); err != nil {
+		v.fail("HTTPS.Cert", "%v", err)
+	}
+
+	if c.Login.User == "" {
+		v.fail("Login.User", "must not be empty")
+	}
+
+	files := reflect.ValueOf(c.Files)
+	for i := 0; i < files.NumField(); i++ {
+		field := "Files." + files.Type().Field(i).Name
+		p := files.Field(i).String()
+		if p == "" {
+			if field != "Files.MQTTQueue" {
+				v.fail(field, "must not be empty")
+			}
+			continue
+		}
+		if fi, err := os.Stat(filepath.Dir(p)); err != nil {
+			v.fail(field, "%v", err)
+		} else if !fi.IsDir() {
+			v.fail(field, "%s is not a directory", filepath.Dir(p))
+		} else if err = checkWritable(p); err != nil {
+			v.fail(field, "%v", err)
+		}
+	}
+
+	if c.MQTT.Server != "" {
+		if c.MQTT.Plant1Topic == "" {
+			v.fail("MQTT.Plant1Topic", "must not be empty")
+		}
+		if c.MQTT.Plant2Topic == "" {
+			v.fail("MQTT.Plant2Topic", "must not be empty")
+		}
+		if c.MQTT.CACert != "" || c.MQTT.ClientCert != "" {
+			if _, err := c.MQTT.tlsConfig(); err != nil {
+				v.fail("MQTT.CACert", "%v", err)
+			}
+		}
+	}
+	switch c.MQTT.Payload {
+	case "", payloadValue, payloadJSON:
+	default:
+		v.fail("MQTT.Payload", "must be %q or %q, got %q", payloadValue, payloadJSON, c.MQTT.Payload)
+	}
+
+	if c.Log.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+			v.fail("Log.Level", "%v", err)
+		}
+	}
+	v.notNegative("Log.Buffer", c.Log.Buffer)
+
+	v.notNegative("Reservoir.Empty", c.Reservoir.Empty)
+	if c.Reservoir.Low < c.Reservoir.Empty {
+		v.fail("Reservoir.Low", "must not be below Empty %v, got %v", c.Reservoir.Empty, c.Reservoir.Low)
+	}
+	if c.Reservoir.AlertDays < 0 {
+		v.fail("Reservoir.AlertDays", "must not be negative, got %v", c.Reservoir.AlertDays)
+	}
+
+	v.notNegative("Limits.DailyMs", c.Limits.DailyMs)
+	v.notNegative("Limits.MaxWaterDays", c.Limits.MaxWaterDays)
+	v.notNegative("Limits.MinGap", c.Limits.MinGap)
+
+	if c.Location.Latitude < -90 || c.Location.Latitude > 90 {
+		v.fail("Location.Latitude", "must be between -90 and 90, got %v", c.Location.Latitude)
+	}
+	if c.Location.Longitude < -180 || c.Location.Longitude > 180 {
+		v.fail("Location.Longitude", "must be between -180 and 180, got %v", c.Location.Longitude)
+	}
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// checkWritable returns an error if the file cannot be written, trying
+// to create a file in its directory if it does not exist.
+func checkWritable(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		f, err = ioutil.TempFile(filepath.Dir(file), ".plantstation")
+		if err == nil {
+			defer os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// changedSections returns the names of the sections differing between two
+// server configurations.
+func changedSections(a, b *serverConfig) []string {
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	var changed []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// An httpsListener serves the HTTP handlers over TLS. The listener can be
+// moved to another address and the certificate reloaded without dropping
+// requests.
+type httpsListener struct {
+	mutex  sync.Mutex
+	server *http.Server
+	cert   *tls.Certificate
+}
+
+func (l *httpsListener) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.cert, nil
+}
+
+// loadCertificate replaces the certificate of the listener.
+func (l *httpsListener) loadCertificate(c httpsConfig) error {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.cert = &cert
+	l.mutex.Unlock()
+	return nil
+}
+
+// listen binds the address and starts serving on it before the previous
+// server shuts down. The previous server shuts down in the background, as
+// the request reloading the config may be one of its pending requests.
+func (l *httpsListener) listen(c httpsConfig) error {
+	if err := l.loadCertificate(c); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      c.Addr,
+		TLSConfig: &tls.Config{GetCertificate: l.certificate},
+	}
+	go func() {
+		err := server.ServeTLS(ln, "", "")
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	l.mutex.Lock()
+	old := l.server
+	l.server = server
+	l.mutex.Unlock()
+
+	if old != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := old.Shutdown(ctx); err != nil {
+				logger("http").Warn("failed to shut down previous listener", "err", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// shutdown stops serving after the pending requests.
+func (l *httpsListener) shutdown() {
+	l.mutex.Lock()
+	server := l.server
+	l.mutex.Unlock()
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
+
+// startMQTT connects to the MQTT broker and subscribes the commands.
+func (s *station) startMQTT() error {
+	c := s.serverConfig()
+	p, err := newMQTTPublisher(c.MQTT, c.Files.MQTTQueue)
+	if err != nil {
+		return err
+	}
+
+	s.mqttMutex.Lock()
+	s.mqtt = p
+	s.mqttMutex.Unlock()
+
+	s.subscribeModes()
+	s.subscribeWatering()
+	go p.run()
+	s.publishModes()
+	return nil
+}
+
+// stopMQTT disconnects from the MQTT broker.
+func (s *station) stopMQTT() {
+	s.mqttMutex.Lock()
+	p := s.mqtt
+	s.mqtt = nil
+	s.mqttMutex.Unlock()
+
+	if p != nil {
+		p.close()
+	}
+}
+
+// publisher returns the MQTT publisher, nil if MQTT is not configured.
+func (s *station) publisher() *mqttPublisher {
+	s.mqttMutex.RLock()
+	defer s.mqttMutex.RUnlock()
+	return s.mqtt
+}
+
+// A reloadResult reports the outcome of reloading the server configuration.
+type reloadResult struct {
+	// Changed lists the changed sections
+	Changed []string `json:"changed"`
+	// Actions lists what was done to apply the changes
+	Actions []string `json:"actions"`
+	// Errors lists the changes which failed to apply
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (r *reloadResult) action(format string, args ...interface{}) {
+	r.Actions = append(r.Actions, fmt.Sprintf(format, args...))
+}
+
+func (r *reloadResult) fail(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// writeState writes the plant config and the stored state to the files.
+func (s *station) writeState(files filesConfig) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	state := []struct {
+		file string
+		v    interface{}
+	}{
+		{files.Config, &s.Config},
+		{files.Data, &s.Data},
+		{files.WaterTime, &s.WateringTimeData},
+		{files.Calibration, &s.Calibration},
+		{files.Mode, &s.Modes},
+		{files.Ledger, &s.Ledger},
+		{files.Decisions, &s.decisions},
+		{files.History, &s.configHistory},
+	}
+	for _, st := range state {
+		b, err := json.Marshal(st.v)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(st.file, b, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadServerConfig reads and validates the server configuration and
+// applies it if valid. MQTT reconnects and the listener is rebound only if
+// their sections changed.
+func (s *station) reloadServerConfig() (reloadResult, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	res := reloadResult{Changed: []string{}, Actions: []string{}}
+
+	c, err := s.configFile.load(s.configOverrides)
+	if err != nil {
+		return res, err
+	}
+	if err = c.validate(); err != nil {
+		return res, err
+	}
+	// the schedules may depend on the location
+	s.mutex.RLock()
+	err = validatePlantConfigs(&s.Config, c.Location)
+	s.mutex.RUnlock()
+	if err != nil {
+		return res, err
+	}
+
+	// the state moves to the new files before they are used
+	old := s.serverConfig()
+	if old.Files != c.Files {
+		if err = s.writeState(c.Files); err != nil {
+			return res, fmt.Errorf("failed to save state to the new files: %v", err)
+		}
+	}
+	s.config.Store(&c)
+
+	changed := map[string]bool{}
+	for _, name := range changedSections(old, &c) {
+		changed[name] = true
+		res.Changed = append(res.Changed, name)
+	}
+
+	if changed["Log"] {
+		setLogLevel(c.Log)
+		res.action("log level set to %v", logLevel.Level())
+		if c.Log.Buffer != old.Log.Buffer {
+			res.action("log buffer size applies after restart")
+		}
+	}
+
+	if changed["Login"] {
+		res.action("login updated")
+	}
+
+	if changed["Files"] {
+		res.action("state saved to the new files")
+	}
+
+	if changed["MQTT"] || old.Files.MQTTQueue != c.Files.MQTTQueue {
+		s.stopMQTT()
+		res.action("disconnected from MQTT broker")
+		if c.MQTT.Server != "" {
+			if err := s.startMQTT(); err != nil {
+				res.fail("failed to create MQTT client: %v", err)
+			} else {
+				res.action("connecting to MQTT broker %v", c.MQTT.Server)
+			}
+		}
+	}
+
+	if changed["HTTPS"] && old.HTTPS.Addr != c.HTTPS.Addr {
+		if err := s.https.listen(c.HTTPS); err != nil {
+			res.fail("failed to listen on %v: %v", c.HTTPS.Addr, err)
+		} else {
+			res.action("listening on %v", c.HTTPS.Addr)
+		}
+	} else if err := s.https.loadCertificate(c.HTTPS); err != nil {
+		res.fail("failed to load certificate: %v", err)
+	} else {
+		res.action("certificate reloaded")
+	}
+
+	l := logger("config")
+	l.Info("server config reloaded", "changed", res.Changed, "actions", res.Actions)
+	for _, e := range res.Errors {
+		l.Error("failed to apply server config", "err", e)
+	}
+
+	return res, nil
+}
+
+// reloadHandler reloads the server configuration and reports the outcome.
+func reloadHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := s.reloadServerConfig()
+		if err != nil {
+			logger("config").Error("invalid server config, keeping current", "err", err)
+			writeValidationError(w, err)
+			return
+		}
+		writeJSON(w, res)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "math"
+
+// reservoirState is the last known reservoir level of a plant and the
+// estimated days until it runs empty, -1 if unknown.
+type reservoirState struct {
+	Level int     `json:"level"`
+	OK    bool    `json:"ok"`
+	Days  float64 `json:"days"`
+}
+
+// pollReservoir reads the reservoir levels, falling back to the last level
+// read if the measurement fails.
+func (s *station) pollReservoir(m *minuteSample) {
+	for i := range m.limit {
+		l, err := s.wuc.ReadWateringLimit(i)
+
+		s.mutex.Lock()
+		state := &s.ReservoirStatus[i]
+		if err != nil {
+			plantLogger("wuc", i).Warn("failed to read watering limit", "err", err)
+			m.limitStatus[i] = sensorFallback
+		} else {
+			state.Level = l
+			m.limitStatus[i] = sensorOK
+		}
+		state.OK = err == nil
+		m.limit[i] = state.Level
+		s.waterLimit[i] = state.Level
+		s.mutex.Unlock()
+	}
+}
+
+// hourLevel returns the median of the last hour's reservoir levels.
+func (s *station) hourLevel(index int) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	levels := s.MinData.Level[index]
+	if len(levels) == 0 {
+		return s.ReservoirStatus[index].Level
+	}
+	return hourMedian(levels)
+}
+
+// reservoirDays estimates the days until the reservoir of the plant is empty
+// from the decline of the hourly levels during the last week. Rises by
+// refilling are ignored. It returns -1 if there is no consumption yet. The
+// caller must hold the mutex.
+func (s *station) reservoirDays(index int) float64 {
+	levels := s.Data.Level[index]
+	n := len(levels)
+	i0 := 0
+	if n > 7*24 {
+		i0 = n - 7*24
+	}
+
+	used := 0
+	for i := i0 + 1; i < n; i++ {
+		if d := levels[i-1] - levels[i]; d > 0 {
+			used += d
+		}
+	}
+
+	hours := n - 1 - i0
+	if used == 0 || hours < 24 {
+		return -1
+	}
+
+	perDay := float64(used) / float64(hours) * 24
+	days := float64(levels[n-1]-s.serverConfig().Reservoir.Empty) / perDay
+	return math.Max(0, math.Round(days*10)/10)
+}
+
+// checkReservoir updates the estimate of the remaining days and raises or
+// clears the reservoir alerts of the plant.
+func (s *station) checkReservoir(index int) {
+	c := s.serverConfig()
+	s.mutex.Lock()
+	days := s.reservoirDays(index)
+	s.ReservoirStatus[index].Days = days
+	state := s.ReservoirStatus[index]
+	s.mutex.Unlock()
+
+	if !state.OK {
+		return
+	}
+
+	if c.Reservoir.Empty > 0 || c.Reservoir.Low > 0 {
+		if state.Level <= c.Reservoir.Empty {
+			s.raiseAlert(alertReservoirEmpty, index, "reservoir of plant %v is empty, level %v",
+				index+1, state.Level)
+		} else {
+			s.clearAlert(alertReservoirEmpty, index)
+		}
+	}
+
+	low := state.Level < c.Reservoir.Low ||
+		(days >= 0 && days < c.Reservoir.AlertDays)
+	if low {
+		s.raiseAlert(alertReservoirLow, index, "reservoir of plant %v is low, level %v, %v days left",
+			index+1, state.Level, days)
+	} else {
+		s.clearAlert(alertReservoirLow, index)
+	}
+}
+
+// reservoirLimit shortens the watering time when the reservoir level is
+// below the low threshold, in proportion to the level left above empty.
+// No watering takes place at or below the empty threshold. If the level
+// cannot be read, the last level read applies, and without any the
+// watering is skipped.
+func (s *station) reservoirLimit(index, ms int) int {
+	s.mutex.RLock()
+	state := s.ReservoirStatus[index]
+	s.mutex.RUnlock()
+
+	c := s.serverConfig().Reservoir
+	if c.Low == 0 && c.Empty == 0 {
+		return ms
+	}
+
+	l := plantLogger("reservoir", index)
+	if !state.OK {
+		l.Warn("reservoir level unknown, using last level", "level", state.Level)
+	}
+	switch {
+	case state.Level <= c.Empty:
+		l.Warn("reservoir empty, skipping watering", "level", state.Level, "ms", ms)
+		s.raiseAlert(alertReservoirEmpty, index, "reservoir of plant %v is empty, level %v",
+			index+1, state.Level)
+		return 0
+	case state.Level < c.Low:
+		short := ms * (state.Level - c.Empty) / (c.Low - c.Empty)
+		l.Warn("reservoir low, shortening watering",
+			"level", state.Level, "ms", ms, "shortened", short)
+		return short
+	}
+	return ms
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A schedule yields the times of recurring events.
+type schedule interface {
+	// next returns the first time after t, truncated to minutes.
+	next(t time.Time) time.Time
+}
+
+// parseSchedule parses a cron expression with the five fields minute, hour,
+// day of month, month and day of week, or a time relative to sunrise or
+// sunset like "sunrise", "sunrise-30m" or "sunset+1h15m".
+func parseSchedule(spec string, loc location) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	for _, event := range []string{"sunrise", "sunset"} {
+		if strings.HasPrefix(spec, event) {
+			return parseSunSchedule(spec, event, loc)
+		}
+	}
+	return parseCron(spec)
+}
+
+type scheduleKey struct {
+	spec string
+	loc  location
+}
+
+// parsedSchedules caches the valid schedules by spec and location, so they
+// are parsed once on validation instead of by every minute update.
+var parsedSchedules sync.Map
+
+// cachedSchedule returns the schedule parsed by parseSchedule, parsing a
+// valid spec on first use only.
+func cachedSchedule(spec string, loc location) (schedule, error) {
+	key := scheduleKey{spec, loc}
+	if sched, ok := parsedSchedules.Load(key); ok {
+		return sched.(schedule), nil
+	}
+	sched, err := parseSchedule(spec, loc)
+	if err != nil {
+		return nil, err
+	}
+	parsedSchedules.Store(key, sched)
+	return sched, nil
+}
+
+// scheduleDue reports whether the schedule has an event in the minute of t.
+func scheduleDue(sched schedule, t time.Time) bool {
+	minute := t.Truncate(time.Minute)
+	return sched.next(minute.Add(-time.Second)).Equal(minute)
+}
+
+type sunSchedule struct {
+	loc    location
+	sunset bool
+	offset time.Duration
+}
+
+func parseSunSchedule(spec, event string, loc location) (schedule, error) {
+	s := &sunSchedule{loc: loc, sunset: event == "sunset"}
+	if o := strings.TrimPrefix(spec, event); o != "" {
+		if o[0] != '+' && o[0] != '-' {
+			return nil, fmt.Errorf("invalid offset in %q", spec)
+		}
+		var err error
+		if s.offset, err = time.ParseDuration(o); err != nil {
+			return nil, fmt.Errorf("invalid offset in %q: %v", spec, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *sunSchedule) next(t time.Time) time.Time {
+	// the offset may move the event into the previous or next day
+	for d := -1; d < 366; d++ {
+		rise, set, ok := s.loc.sunriseSunset(t.AddDate(0, 0, d))
+		if !ok {
+			continue
+		}
+		e := rise
+		if s.sunset {
+			e = set
+		}
+		e = e.Add(s.offset).Truncate(time.Minute)
+		if e.After(t) {
+			return e
+		}
+	}
+	return time.Time{}
+}
+
+// cronSchedule holds the allowed values of each field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow [64]bool
+	// day of month and day of week restrict together if both are given
+	anyDom, anyDow bool
+}
+
+func parseCron(spec string) (schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields", spec)
+	}
+
+	c := &cronSchedule{
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}
+
+	ranges := []struct {
+		set      *[64]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+
+	for i, f := range fields {
+		r := ranges[i]
+		if err := parseCronField(f, r.set, r.min, r.max); err != nil {
+			return nil, fmt.Errorf("invalid cron field %q: %v", f, err)
+		}
+	}
+
+	// 7 is an alias for sunday
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges with
+// optional steps.
+func parseCronField(field string, set *[64]bool, min, max int) error {
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return fmt.Errorf("invalid step %q", item[i+1:])
+			}
+			item = item[:i]
+		}
+
+		lo, hi := min, max
+		if item != "*" {
+			var err error
+			bounds := strings.SplitN(item, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return err
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%d-%d out of range %d-%d", lo, hi, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// every valid expression matches within a few years
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var berlin = location{Latitude: 52.52, Longitude: 13.405}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	tz, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	return tz
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 31, 22, 10, 30, 0, time.UTC) // a wednesday
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 22, 11, 0, 0, time.UTC)},
+		{"0 7 * * *", time.Date(2024, 2, 1, 7, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 22, 15, 0, 0, time.UTC)},
+		{"30 6-8/2 * * *", time.Date(2024, 2, 1, 6, 30, 0, 0, time.UTC)},
+		{"0 12 * * 0", time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+		// day of month or day of week if both are given
+		{"0 9 15 * 5", time.Date(2024, 2, 2, 9, 0, 0, 0, time.UTC)},
+		{"5,45 22 * 1 *", time.Date(2024, 1, 31, 22, 45, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		sched, err := parseSchedule(tt.spec, location{})
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if next := sched.next(from); !next.Equal(tt.next) {
+			t.Errorf("%q: next = %v, want %v", tt.spec, next, tt.next)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "5-1 * * * *", "*/0 * * * *", "x * * * *",
+		"sunrise30m", "sunset+1x", "sundown",
+	} {
+		if _, err := parseSchedule(spec, berlin); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestSunriseSunset(t *testing.T) {
+	tz := mustLoadLocation(t, "Europe/Berlin")
+	tests := []struct {
+		day       time.Time
+		rise, set string
+	}{
+		{time.Date(2024, 6, 21, 0, 0, 0, 0, tz), "04:43", "21:33"},
+		{time.Date(2024, 12, 21, 23, 0, 0, 0, tz), "08:15", "15:54"},
+	}
+	for _, tt := range tests {
+		rise, set, ok := berlin.sunriseSunset(tt.day)
+		if !ok {
+			t.Errorf("%v: no sunrise", tt.day)
+			continue
+		}
+		near(t, "sunrise", rise, tt.day, tt.rise)
+		near(t, "sunset", set, tt.day, tt.set)
+	}
+
+	tromso := location{Latitude: 69.65, Longitude: 18.96}
+	if _, _, ok := tromso.sunriseSunset(time.Date(2024, 12, 21, 12, 0, 0, 0, tz)); ok {
+		t.Error("sunrise in the polar night")
+	}
+	if _, _, ok := tromso.sunriseSunset(time.Date(2024, 6, 21, 12, 0, 0, 0, tz)); ok {
+		t.Error("sunset in the midnight sun")
+	}
+}
+
+// near checks that tm is within 3 minutes of the clock time hhmm on day.
+func near(t *testing.T, name string, tm, day time.Time, hhmm string) {
+	t.Helper()
+	clock, _ := time.Parse("15:04", hhmm)
+	want := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, day.Location())
+	if d := tm.Sub(want); d < -3*time.Minute || d > 3*time.Minute {
+		t.Errorf("%v = %v, want about %v", name, tm, want)
+	}
+}
+
+func TestSunScheduleNext(t *testing.T) {
+	tz := mustLoadLocation(t, "Europe/Berlin")
+	from := time.Date(2024, 6, 21, 12, 0, 0, 0, tz)
+
+	sunset, _ := parseSchedule("sunset", berlin)
+	next := sunset.next(from)
+	near(t, "sunset", next, from, "21:33")
+	if next.Second() != 0 {
+		t.Errorf("sunset %v not truncated to minutes", next)
+	}
+
+	// the sunrise of the day has passed
+	sunrise, _ := parseSchedule("sunrise-30m", berlin)
+	near(t, "sunrise-30m", sunrise.next(from), from.AddDate(0, 0, 1), "04:13")
+
+	// the offset moves the event into the afternoon of the day
+	late, _ := parseSchedule("sunrise+9h", berlin)
+	near(t, "sunrise+9h", late.next(from), from, "13:43")
+
+	if !scheduleDue(sunset, next.Add(30*time.Second)) {
+		t.Errorf("sunset not due at %v", next)
+	}
+	if scheduleDue(sunset, next.Add(time.Minute)) {
+		t.Errorf("sunset due a minute after %v", next)
+	}
+}
+
+func TestCachedSchedule(t *testing.T) {
+	a, err := cachedSchedule("sunrise", berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := cachedSchedule("sunrise", berlin); a != b {
+		t.Error("schedule parsed again")
+	}
+	if c, _ := cachedSchedule("sunrise", location{Latitude: 48.14, Longitude: 11.58}); a == c {
+		t.Error("schedule of another location taken from the cache")
+	}
+	if _, err := cachedSchedule("0 25 * * *", berlin); err == nil {
+		t.Error("invalid schedule accepted from the cache")
+	}
+}
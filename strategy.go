@@ -0,0 +1,295 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+)
+
+const (
+	strategyThreshold    = "threshold"
+	strategySchedule     = "schedule"
+	strategyProportional = "proportional"
+)
+
+// wateringInput holds what a strategy bases its decision on.
+type wateringInput struct {
+	time   decisionTime
+	weight int
+	config *plantConfig
+	// duration of the last watering in ms and hours since then
+	lastw int
+	durw  int
+	// dryout per 24h and the factor expected from the climate forecast
+	dryout  int
+	climate float64
+	// watering time per weight unit and watering time offset
+	scale  int
+	offset int
+	// the window of this watering and the hours until the next one
+	window    wateringWindow
+	nextHours int
+
+	log *slog.Logger
+	// decision records the strategy's reasoning if not nil
+	decision *wateringDecision
+}
+
+// target returns the level the plant is filled up to in this window.
+func (in *wateringInput) target() int {
+	if in.window.Target > 0 {
+		return in.window.Target
+	}
+	return in.config.HighLevel
+}
+
+// wateringTime returns the time needed for the weight gain dw.
+func (in *wateringInput) wateringTime(dw int) int {
+	return in.scale*dw + in.offset
+}
+
+// A decisionTime is the moment of a watering decision. Hourly decisions are
+// made by the hourly update for entries given by hour, the others by the
+// minute update for entries given by a schedule.
+type decisionTime struct {
+	time.Time
+	hourly bool
+	loc    location
+}
+
+// A timing is when a watering window or scheduled watering takes place,
+// either at the full hour or by a schedule as accepted by parseSchedule.
+type timing struct {
+	Hour int    `json:"hour"`
+	At   string `json:"at,omitempty"`
+}
+
+func (tm *timing) due(dt decisionTime) bool {
+	if tm.At == "" {
+		return dt.hourly && dt.Hour() == tm.Hour
+	}
+	if dt.hourly {
+		return false
+	}
+	// invalid schedules are rejected by validation
+	sched, err := cachedSchedule(tm.At, dt.loc)
+	if err != nil {
+		return false
+	}
+	return scheduleDue(sched, dt.Time)
+}
+
+// next returns the first time after t.
+func (tm *timing) next(t time.Time, loc location) time.Time {
+	if tm.At == "" {
+		n := time.Date(t.Year(), t.Month(), t.Day(), tm.Hour, 0, 0, 0, t.Location())
+		if !n.After(t) {
+			n = n.AddDate(0, 0, 1)
+		}
+		return n
+	}
+	sched, err := cachedSchedule(tm.At, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return sched.next(t)
+}
+
+// A wateringStrategy decides when and how long a plant is watered.
+type wateringStrategy interface {
+	// due reports whether the strategy decides about watering at the time.
+	due(config *plantConfig, dt decisionTime) bool
+	// water returns the watering time in ms, zero for no watering.
+	water(in *wateringInput) int
+}
+
+var wateringStrategies = map[string]wateringStrategy{
+	strategyThreshold:    thresholdRefill{},
+	strategySchedule:     fixedSchedule{},
+	strategyProportional: proportionalControl{},
+}
+
+// strategy returns the configured strategy, threshold refill by default.
+func (c *plantConfig) strategy() wateringStrategy {
+	if st, ok := wateringStrategies[c.Strategy]; ok {
+		return st
+	}
+	return thresholdRefill{}
+}
+
+// thresholdRefill refills the plant at the watering hour when it would fall
+// below the low level before the next watering.
+type thresholdRefill struct{}
+
+func (thresholdRefill) due(config *plantConfig, dt decisionTime) bool {
+	return config.windowAt(dt) != nil
+}
+
+func (thresholdRefill) water(in *wateringInput) int {
+	config := in.config
+	l := in.log
+	high := in.target()
+	dw := 0
+	wt := 0
+	branch := "no refill needed"
+
+	// expected dryout until the next watering, adjusted to the forecast
+	// climate, none if the next watering is within the hour
+	hours := in.nextHours - 1
+	if hours < 0 {
+		hours = 0
+	}
+	expected := int(math.Round(float64(in.dryout*hours) / 24 * in.climate))
+	minLevel := config.LowLevel + expected
+
+	// refills aim into the target band around the high level
+	bandLow := high - config.LevelRange
+	bandHigh := high + config.LevelRange
+
+	if in.weight <= config.LowLevel {
+		// full refill
+		dw = high - in.weight
+		wt = in.wateringTime(dw)
+		branch = "full refill"
+	} else if in.window.Fraction > 0 {
+		// share of the daily need, not exceeding the target band
+		dw = int(math.Round(float64(in.dryout) * in.window.Fraction * in.climate))
+		if in.weight+dw > bandHigh {
+			dw = bandHigh - in.weight
+		}
+		if dw > 0 {
+			wt = in.wateringTime(dw)
+		}
+		branch = "fractional refill"
+		l.Info("fractional refill", "fraction", in.window.Fraction)
+	} else if in.weight < minLevel {
+		dwhi := high - in.weight
+		dwlo := clamp(minLevel, bandLow, bandHigh) - in.weight
+		hiwt := in.wateringTime(dwhi)
+		lowt := in.wateringTime(dwlo)
+		if minLevel > bandHigh {
+			branch = "refill clamped to target band"
+			dw = dwlo
+			wt = lowt
+		} else if minLevel > high {
+			branch = "refill above high level"
+			dw = dwlo
+			wt = lowt
+		} else if abs(hiwt-in.lastw) > abs(lowt-in.lastw) {
+			branch = "refill to high level"
+			dw = dwhi
+			wt = hiwt
+		} else {
+			branch = "minimum refill"
+			dw = dwlo
+			wt = lowt
+		}
+	}
+
+	l.Info("threshold refill", "climate", in.climate, "expected", expected)
+	in.explain(branch, dw, wt)
+
+	if wt > 0 {
+		return clamp(wt, config.WaterStart, config.MaxWater)
+	}
+	return 0
+}
+
+// scheduledWatering is a fixed watering time.
+type scheduledWatering struct {
+	timing
+	Ms int `json:"ms"`
+}
+
+// fixedSchedule waters fixed times at fixed hours regardless of the weight.
+type fixedSchedule struct{}
+
+func (fixedSchedule) due(config *plantConfig, dt decisionTime) bool {
+	for i := range config.Schedule {
+		if config.Schedule[i].due(dt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fixedSchedule) water(in *wateringInput) int {
+	wt := 0
+	for i := range in.config.Schedule {
+		if in.config.Schedule[i].due(in.time) {
+			wt += in.config.Schedule[i].Ms
+		}
+	}
+	in.explain("scheduled watering", 0, wt)
+	if wt > 0 {
+		return clamp(wt, 0, in.config.MaxWater)
+	}
+	return 0
+}
+
+// proportionalControl waters at the watering hour proportionally to the
+// weight missing to the high level. Without a configured gain the learned
+// watering time per weight unit is used.
+type proportionalControl struct{}
+
+func (proportionalControl) due(config *plantConfig, dt decisionTime) bool {
+	return config.windowAt(dt) != nil
+}
+
+func (proportionalControl) water(in *wateringInput) int {
+	e := in.target() - in.weight
+	gain := in.config.Gain
+	if gain <= 0 {
+		gain = float64(in.scale)
+	}
+
+	wt := int(math.Round(gain * float64(e)))
+	in.log.Info("proportional control", "gain", gain)
+	in.explain("proportional to missing weight", e, wt)
+
+	if e <= 0 || wt < in.config.WaterStart {
+		return 0
+	}
+	return clamp(wt, in.config.WaterStart, in.config.MaxWater)
+}
+
+// A wateringWindow is a time at which the threshold and proportional
+// strategies decide about watering.
+type wateringWindow struct {
+	timing
+	// Target overrides the high level for this window.
+	Target int `json:"target,omitempty"`
+	// Fraction of the daily dryout to water instead of refilling to a level.
+	Fraction float64 `json:"fraction,omitempty"`
+}
+
+// windows returns the configured watering windows, by default one at WaterHour.
+func (c *plantConfig) windows() []wateringWindow {
+	if len(c.Windows) > 0 {
+		return c.Windows
+	}
+	return []wateringWindow{{timing: timing{Hour: c.WaterHour}}}
+}
+
+// windowAt returns the watering window due at the time or nil.
+func (c *plantConfig) windowAt(dt decisionTime) *wateringWindow {
+	windows := c.windows()
+	for i := range windows {
+		if windows[i].due(dt) {
+			return &windows[i]
+		}
+	}
+	return nil
+}
+
+// hoursToNextWindow returns the hours until the next window, at most a day.
+func (c *plantConfig) hoursToNextWindow(dt decisionTime) int {
+	next := 24 * time.Hour
+	for _, w := range c.windows() {
+		n := w.next(dt.Time, dt.loc)
+		if d := n.Sub(dt.Time); !n.IsZero() && d > 0 && d < next {
+			next = d
+		}
+	}
+	return int(math.Round(next.Hours()))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestThresholdRefillExpectedDryout(t *testing.T) {
+	config := plantConfig{LowLevel: 100, HighLevel: 200, LevelRange: 20, MaxWater: 20000}
+	tests := []struct {
+		weight, nextHours int
+		branch            string
+	}{
+		{99, 1, "full refill"},
+		// 30 per day over 2 hours are 2.5, which must not be truncated
+		{102, 3, "refill to high level"},
+		{103, 3, "no refill needed"},
+		// the next watering is within the hour
+		{101, 1, "no refill needed"},
+		{101, 0, "no refill needed"},
+	}
+	for _, tt := range tests {
+		var d wateringDecision
+		in := wateringInput{
+			weight:    tt.weight,
+			config:    &config,
+			dryout:    30,
+			climate:   1,
+			scale:     40,
+			nextHours: tt.nextHours,
+			log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+			decision:  &d,
+		}
+		thresholdRefill{}.water(&in)
+		if d.Branch != tt.branch {
+			t.Errorf("weight %v, next in %vh: %q, want %q", tt.weight, tt.nextHours, d.Branch, tt.branch)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// A location is the geographic position of the station.
+type location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// configured reports whether the location is set, the zero location being
+// taken as missing.
+func (l *location) configured() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+)
+
+func degSin(d float64) float64 { return math.Sin(d * math.Pi / 180) }
+func degCos(d float64) float64 { return math.Cos(d * math.Pi / 180) }
+
+func julianToTime(j float64) time.Time {
+	return time.Unix(0, int64((j-julianUnixEpoch)*86400*1e9))
+}
+
+// sunriseSunset calculates sunrise and sunset of the day containing t by
+// the sunrise equation. ok is false if the sun does not rise or set.
+func (l *location) sunriseSunset(t time.Time) (rise, set time.Time, ok bool) {
+	// julian day number of local noon
+	noon := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, t.Location())
+	jd := float64(noon.Unix())/86400 + julianUnixEpoch
+	n := math.Round(jd - julian2000 + 0.0008)
+
+	// mean solar time
+	js := n - l.Longitude/360
+	// solar mean anomaly
+	m := math.Mod(357.5291+0.98560028*js, 360)
+	// equation of the center
+	c := 1.9148*degSin(m) + 0.02*degSin(2*m) + 0.0003*degSin(3*m)
+	// ecliptic longitude
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	// solar transit
+	transit := julian2000 + js + 0.0053*degSin(m) - 0.0069*degSin(2*lambda)
+	// declination of the sun
+	sinDecl := degSin(lambda) * degSin(23.4397)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	// hour angle, including refraction and the sun's diameter
+	cosOmega := (degSin(-0.833) - degSin(l.Latitude)*sinDecl) / (degCos(l.Latitude) * cosDecl)
+	if cosOmega < -1 || cosOmega > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	omega := math.Acos(cosOmega) * 180 / math.Pi
+
+	rise = julianToTime(transit - omega/360).In(t.Location())
+	set = julianToTime(transit + omega/360).In(t.Location())
+	return rise, set, true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A fieldError describes an invalid value of a configuration field given by
+// its JSON path.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"msg"`
+}
+
+// validationErrors are the errors of all invalid fields.
+type validationErrors []fieldError
+
+func (e validationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validator collects the field errors of a configuration.
+type validator struct {
+	errors validationErrors
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, fieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) between(field string, value, min, max int) {
+	if value < min || value > max {
+		v.fail(field, "must be between %v and %v, got %v", min, max, value)
+	}
+}
+
+func (v *validator) notNegative(field string, value int) {
+	if value < 0 {
+		v.fail(field, "must not be negative, got %v", value)
+	}
+}
+
+func (v *validator) timing(field string, t *timing, loc location) {
+	if t.At == "" {
+		v.between(field+".hour", t.Hour, 0, 23)
+		return
+	}
+	sched, err := cachedSchedule(t.At, loc)
+	if err != nil {
+		v.fail(field+".at", "%v", err)
+		return
+	}
+	if _, ok := sched.(*sunSchedule); ok && !loc.configured() {
+		v.fail(field+".at", "%q needs the Location of the station", t.At)
+	}
+}
+
+// validate checks the plant configuration for the station at loc and
+// returns the errors of all invalid fields or nil.
+func (c *plantConfig) validate(loc location) error {
+	v := &validator{}
+
+	v.between("hour", c.WaterHour, 0, 23)
+	v.between("start", c.WaterStart, 0, maxWateringTime)
+	v.between("max", c.MaxWater, 0, maxWateringTime)
+	if c.WaterStart > c.MaxWater {
+		v.fail("start", "must not exceed max %v, got %v", c.MaxWater, c.WaterStart)
+	}
+
+	v.notNegative("low", c.LowLevel)
+	v.notNegative("dst", c.HighLevel)
+	v.notNegative("range", c.LevelRange)
+	if c.LowLevel > c.HighLevel {
+		v.fail("low", "must not exceed dst %v, got %v", c.HighLevel, c.LowLevel)
+	}
+
+	if _, ok := wateringStrategies[c.Strategy]; !ok && c.Strategy != "" {
+		v.fail("strategy", "unknown strategy %q", c.Strategy)
+	}
+	if c.Strategy == strategySchedule && len(c.Schedule) == 0 {
+		v.fail("schedule", "must not be empty for strategy %q", c.Strategy)
+	}
+
+	for i := range c.Schedule {
+		f := fmt.Sprintf("schedule[%v]", i)
+		v.timing(f, &c.Schedule[i].timing, loc)
+		v.between(f+".ms", c.Schedule[i].Ms, 0, maxWateringTime)
+	}
+
+	if c.Gain < 0 {
+		v.fail("gain", "must not be negative, got %v", c.Gain)
+	}
+
+	for i := range c.Windows {
+		f := fmt.Sprintf("windows[%v]", i)
+		w := &c.Windows[i]
+		v.timing(f, &w.timing, loc)
+		v.notNegative(f+".target", w.Target)
+		if w.Fraction < 0 || w.Fraction > 1 {
+			v.fail(f+".fraction", "must be between 0 and 1, got %v", w.Fraction)
+		}
+	}
+
+	v.notNegative("limits.dailyms", c.Limits.DailyMs)
+	v.notNegative("limits.maxdays", c.Limits.MaxWaterDays)
+	v.notNegative("limits.mingap", c.Limits.MinGap)
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// validatePlantConfigs validates the configuration of both plants, the
+// fields prefixed by the plant index.
+func validatePlantConfigs(configs *[2]plantConfig, loc location) error {
+	var errs validationErrors
+	for i := range configs {
+		if err := configs[i].validate(loc); err != nil {
+			for _, e := range err.(validationErrors) {
+				e.Field = fmt.Sprintf("[%v].%v", i, e.Field)
+				errs = append(errs, e)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// jsonFieldErrors converts errors of decoding JSON to field errors.
+func jsonFieldErrors(err error) validationErrors {
+	switch e := err.(type) {
+	case validationErrors:
+		return e
+	case *json.UnmarshalTypeError:
+		return validationErrors{{
+			Field:   e.Field,
+			Message: fmt.Sprintf("must be %v, got %v", e.Type, e.Value),
+		}}
+	case *json.SyntaxError:
+		return validationErrors{{
+			Message: fmt.Sprintf("%v at offset %v", e, e.Offset),
+		}}
+	default:
+		return validationErrors{{Message: err.Error()}}
+	}
+}
+
+type validationResponse struct {
+	Errors validationErrors `json:"errors"`
+}
+
+// writeValidationError responds with the field errors as JSON.
+func writeValidationError(w http.ResponseWriter, err error) {
+	js, _ := json.Marshal(validationResponse{Errors: jsonFieldErrors(err)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(js)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func errorFields(err error) []string {
+	var fields []string
+	if err != nil {
+		for _, e := range err.(validationErrors) {
+			fields = append(fields, e.Field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config plantConfig
+		fields []string
+	}{
+		{"valid", plantConfig{WaterHour: 7, WaterStart: 1000, MaxWater: 5000, LowLevel: 100, HighLevel: 200}, nil},
+		{"hour", plantConfig{WaterHour: 24}, []string{"hour"}},
+		{"start above max", plantConfig{WaterStart: 2000, MaxWater: 1000}, []string{"start"}},
+		{"low above dst", plantConfig{LowLevel: 300, HighLevel: 200}, []string{"low"}},
+		{"negative", plantConfig{LevelRange: -1, Gain: -1}, []string{"gain", "range"}},
+		{"strategy", plantConfig{Strategy: "flood"}, []string{"strategy"}},
+		{"empty schedule", plantConfig{Strategy: strategySchedule}, []string{"schedule"}},
+		{"schedule", plantConfig{
+			Strategy: strategySchedule,
+			Schedule: []scheduledWatering{{timing{Hour: 25, At: ""}, -1}},
+		}, []string{"schedule[0].hour", "schedule[0].ms"}},
+		{"windows", plantConfig{
+			Windows: []wateringWindow{{timing: timing{Hour: 6}}, {timing: timing{Hour: -1}, Target: -5, Fraction: 2}},
+		}, []string{"windows[1].fraction", "windows[1].hour", "windows[1].target"}},
+		{"sun without location", plantConfig{
+			Windows: []wateringWindow{{timing: timing{At: "sunrise"}}},
+		}, []string{"windows[0].at"}},
+		{"limits", plantConfig{Limits: wateringLimits{DailyMs: -1, MinGap: -1}}, []string{"limits.dailyms", "limits.mingap"}},
+	}
+	for _, tt := range tests {
+		got := errorFields(tt.config.validate(location{}))
+		if len(got) != len(tt.fields) {
+			t.Errorf("%v: errors in %v, want %v", tt.name, got, tt.fields)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.fields[i] {
+				t.Errorf("%v: errors in %v, want %v", tt.name, got, tt.fields)
+				break
+			}
+		}
+	}
+}
+
+func TestValidatePlantConfigs(t *testing.T) {
+	configs := [2]plantConfig{{}, {WaterHour: 30}}
+	got := errorFields(validatePlantConfigs(&configs, location{}))
+	if len(got) != 1 || got[0] != "[1].hour" {
+		t.Errorf("errors in %v, want [1].hour", got)
+	}
+}
+
+func TestSaveConfigRejected(t *testing.T) {
+	s := fileStation(t)
+	s.Config[0] = plantConfig{
+		MaxWater: 10000,
+		Windows:  []wateringWindow{{timing: timing{Hour: 7}}},
+	}
+
+	w := putConfig(t, s, 0, `{"max":20000,"windows":[{"hour":25}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("PUT = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	var res validationResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if fields := errorFields(res.Errors); len(fields) != 1 || fields[0] != "windows[0].hour" {
+		t.Errorf("errors in %v, want windows[0].hour", fields)
+	}
+
+	if s.Config[0].MaxWater != 10000 || s.Config[0].Windows[0].Hour != 7 {
+		t.Errorf("rejected PUT changed the config to %+v", s.Config[0])
+	}
+	if len(s.configHistory) != 0 {
+		t.Errorf("rejected PUT recorded %v versions", len(s.configHistory))
+	}
+
+	w = putConfig(t, s, 0, `{"max":`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of broken JSON = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
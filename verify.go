@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	alertNoGain   = "no-gain"
+	alertOverflow = "overflow"
+
+	// observed weight gains outside these ratios of the expected gain are
+	// considered a failure
+	verifyMinRatio = 0.25
+	verifyMaxRatio = 3
+)
+
+// A pendingVerification is a watering whose effect on the weight is checked
+// at the next hourly update.
+type pendingVerification struct {
+	ms     int
+	weight int
+	sample int
+}
+
+// A lockout disables automatic watering of a plant after a failed
+// verification until it is acknowledged.
+type lockout struct {
+	Kind     string    `json:"kind"`
+	Time     time.Time `json:"time"`
+	Ms       int       `json:"ms"`
+	Expected int       `json:"expected"`
+	Observed int       `json:"observed"`
+}
+
+// expectVerification registers a watering of the plant at the given weight
+// for verification. Waterings before the next hourly update add up.
+func (s *station) expectVerification(index, ms, weight int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if v := s.verify[index]; v != nil {
+		v.ms += ms
+		return
+	}
+	s.verify[index] = &pendingVerification{
+		ms:     ms,
+		weight: weight,
+		sample: s.Data.Count,
+	}
+}
+
+// expectedGain returns the weight gain of a watering by the learned watering
+// time model, zero if there is none. The caller must hold the mutex.
+func (s *station) expectedGain(index, ms int) int {
+	d := s.WateringTimeData[index]
+	if d.Scale <= 0 {
+		return 0
+	}
+	return int(math.Round(float64(ms-d.Offset) / float64(d.Scale)))
+}
+
+// verifyWatering compares the weight gain since the pending watering with
+// the expected gain and locks out automatic watering on a mismatch.
+func (s *station) verifyWatering(index, weight int) {
+	s.mutex.Lock()
+	v := s.verify[index]
+	s.verify[index] = nil
+	if v == nil {
+		s.mutex.Unlock()
+		return
+	}
+	expected := s.expectedGain(index, v.ms)
+	replanted := false
+	for _, e := range s.Data.Events {
+		if e.Plant == index && e.Sample >= v.sample && e.baseline() {
+			replanted = true
+		}
+	}
+	s.mutex.Unlock()
+
+	l := plantLogger("verify", index)
+	observed := weight - v.weight
+
+	if replanted || expected <= 0 {
+		l.Debug("watering not verifiable", "ms", v.ms, "expected", expected)
+		return
+	}
+
+	l.Info("watering verified", "ms", v.ms, "expected", expected, "observed", observed)
+
+	kind := ""
+	switch {
+	case float64(observed) < float64(expected)*verifyMinRatio:
+		kind = alertNoGain
+	case float64(observed) > float64(expected)*verifyMaxRatio:
+		kind = alertOverflow
+	default:
+		return
+	}
+
+	lo := &lockout{
+		Kind:     kind,
+		Time:     time.Now(),
+		Ms:       v.ms,
+		Expected: expected,
+		Observed: observed,
+	}
+
+	s.mutex.Lock()
+	s.Modes.Lockouts[index] = lo
+	s.mutex.Unlock()
+	s.saveModes()
+
+	if kind == alertNoGain {
+		s.raiseAlert(kind, index, "plant %v watered %v ms but gained %v instead of %v, "+
+			"automatic watering disabled until acknowledged", index+1, v.ms, observed, expected)
+	} else {
+		s.raiseAlert(kind, index, "plant %v gained %v instead of %v after watering %v ms, "+
+			"automatic watering disabled until acknowledged", index+1, observed, expected, v.ms)
+	}
+}
+
+// acknowledge lifts the lockout of the plant and reports whether there was
+// one.
+func (s *station) acknowledge(index int) bool {
+	s.mutex.Lock()
+	lo := s.Modes.Lockouts[index]
+	s.Modes.Lockouts[index] = nil
+	s.mutex.Unlock()
+
+	if lo == nil {
+		return false
+	}
+
+	plantLogger("verify", index).Info("lockout acknowledged", "kind", lo.Kind)
+	s.saveModes()
+	s.clearAlert(lo.Kind, index)
+	return true
+}
+
+// ackHandler shows the lockout of the plant on GET and acknowledges it on
+// POST.
+func ackHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		index := getRequestIndex(r)
+
+		switch r.Method {
+		case http.MethodGet:
+			s.mutex.RLock()
+			js, err := json.Marshal(s.Modes.Lockouts[index])
+			s.mutex.RUnlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+		case http.MethodPost:
+			if !s.acknowledge(index) {
+				http.Error(w, "no lockout", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
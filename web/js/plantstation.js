@@ -1,4 +1,14 @@
 window.onload = function () {
+    function getParam(name) {
+        name = name.replace(/[\[]/, '\\[').replace(/[\]]/, '\\]');
+        var regex = new RegExp('[\\?&]' + name + '=([^&#]*)');
+        var results = regex.exec(location.search);
+        return results === null ? null : decodeURIComponent(results[1].replace(/\+/g, ' '));
+    }
+
+    // shift weights before replant events to keep the series continuous
+    var continuous = getParam('continuous') !== null;
+
     var horizonalLinePlugin = {
         beforeDraw: function (chartInstance) {
             var yValue;
@@ -38,6 +48,25 @@ window.onload = function () {
                     }
                 }
             }
+
+            if (chartInstance.options.verticalLine) {
+                var xScale = chartInstance.scales[chartInstance.options.scales.xAxes[0].id];
+                for (index = 0; index < chartInstance.options.verticalLine.length; index++) {
+                    line = chartInstance.options.verticalLine[index];
+                    var xValue = xScale.getPixelForTick(line.index);
+
+                    ctx.beginPath();
+                    ctx.moveTo(xValue, chartInstance.chartArea.top);
+                    ctx.lineTo(xValue, chartInstance.chartArea.bottom);
+                    ctx.strokeStyle = line.style;
+                    ctx.stroke();
+
+                    if (line.text) {
+                        ctx.fillStyle = line.style;
+                        ctx.fillText(line.text, xValue + 2, chartInstance.chartArea.top + 10);
+                    }
+                }
+            }
             ctx.restore();
         }
     };
@@ -51,7 +80,7 @@ window.onload = function () {
                 {
                     type: 'line',
                     data: [],
-                    label: "Plant Weight 1",
+                    label: "Plant Weight 1 (g)",
                     yAxisID: 'weight-y-axis',
                     borderColor: "#205020",
                     backgroundColor: "#408040",
@@ -60,7 +89,7 @@ window.onload = function () {
                 {
                     type: 'line',
                     data: [],
-                    label: "Plant Weight 2",
+                    label: "Plant Weight 2 (g)",
                     yAxisID: 'weight-y-axis',
                     borderColor: "#306030",
                     backgroundColor: "#509050",
@@ -109,7 +138,7 @@ window.onload = function () {
                 {
                     type: 'line',
                     data: [],
-                    label: "Water Level",
+                    label: "Water Level 1",
                     yAxisID: 'level-y-axis',
                     borderColor: "#001080",
                     backgroundColor: "#0020ff",
@@ -132,11 +161,21 @@ window.onload = function () {
                     borderColor: "#0030a0",
                     backgroundColor: "#1060c0",
                     fill: false
+                },
+                {
+                    type: 'line',
+                    data: [],
+                    label: "Water Level 2",
+                    yAxisID: 'level-y-axis',
+                    borderColor: "#102090",
+                    backgroundColor: "#1030ff",
+                    fill: false
                 }
             ]
         },
         options: {
             horizontalLine: [],
+            verticalLine: [],
             elements: {
                 line: {
                     cubicInterpolationMode: 'monotone'
@@ -195,7 +234,7 @@ window.onload = function () {
                 {
                     type: 'line',
                     data: [],
-                    label: "Plant Weight 1",
+                    label: "Plant Weight 1 (g)",
                     yAxisID: 'weight-y-axis',
                     borderColor: "#205020",
                     backgroundColor: "#408040",
@@ -204,7 +243,7 @@ window.onload = function () {
                 {
                     type: 'line',
                     data: [],
-                    label: "Plant Weight 2",
+                    label: "Plant Weight 2 (g)",
                     yAxisID: 'weight-y-axis',
                     borderColor: "#306030",
                     backgroundColor: "#509050",
@@ -231,15 +270,25 @@ window.onload = function () {
                 {
                     type: 'line',
                     data: [],
-                    label: "Water Level",
+                    label: "Water Level 1",
                     yAxisID: 'level-y-axis',
                     borderColor: "#001080",
                     backgroundColor: "#0020ff",
                     fill: false
+                },
+                {
+                    type: 'line',
+                    data: [],
+                    label: "Water Level 2",
+                    yAxisID: 'level-y-axis',
+                    borderColor: "#102090",
+                    backgroundColor: "#1030ff",
+                    fill: false
                 }
             ]
         },
         options: {
+            verticalLine: [],
             elements: {
                 line: {
                     cubicInterpolationMode: 'monotone'
@@ -290,6 +339,13 @@ window.onload = function () {
         }
     });
 
+    // levels are recorded for a shorter time than the other values
+    function levelAt(data, plant, i, len) {
+        var levels = (data.level || [[], []])[plant] || [];
+        var j = i - (len - levels.length);
+        return j >= 0 ? levels[j] : null;
+    }
+
     function getData() {
         var xhttp = new XMLHttpRequest();
         xhttp.onreadystatechange = function () {
@@ -305,6 +361,26 @@ window.onload = function () {
                 var count1 = 0;
                 var count2 = 0;
                 var i, j, w1, w2;
+                var evcol = ['#a000a0', '#b010b0'];
+                var events = data.events || [];
+                var weights = [data.weight[0].slice(), data.weight[1].slice()];
+
+                events.forEach(function (e) {
+                    var n = weights[e.plant].length;
+                    var p = e.sample - (data.count - n);
+                    if (p < 0 || p >= n)
+                        return;
+                    chart.options.verticalLine.push({
+                        index: p + len - n,
+                        style: evcol[e.plant],
+                        text: e.kind + ' ' + (e.plant + 1)
+                    });
+                    if (continuous) {
+                        for (j = 0; j < p; ++j)
+                            weights[e.plant][j] += e.delta;
+                    }
+                });
+
                 for (i = 0; i < len; ++i) {
                     w1 = data.water[0][i];
                     w2 = data.water[1][i];
@@ -312,14 +388,16 @@ window.onload = function () {
                     chart.data.labels.push(h);
                     // chart.data.datasets[0].data.push(data.moisture[i]);
                     // 4052 is weight value with no load
-                    chart.data.datasets[0].data.push(data.weight[0][i]);
-                    chart.data.datasets[1].data.push(data.weight[1][i]);
+                    chart.data.datasets[0].data.push(weights[0][i]);
+                    chart.data.datasets[1].data.push(weights[1][i]);
                     chart.data.datasets[2].data.push(data.temperature[i] / 100);
                     chart.data.datasets[3].data.push(data.humidity[i] / 100);
                     chart.data.datasets[7].data.push(w1 / 1000);
                     chart.data.datasets[8].data.push(w2 / 1000);
-                    avg1 += data.weight[0][i];
-                    avg2 += data.weight[1][i];
+                    chart.data.datasets[6].data.push(levelAt(data, 0, i, len));
+                    chart.data.datasets[9].data.push(levelAt(data, 1, i, len));
+                    avg1 += weights[0][i];
+                    avg2 += weights[1][i];
                     ++count1;
                     ++count2;
                     if (w1 > 0) {
@@ -381,15 +459,36 @@ window.onload = function () {
                 var mlen = Math.max(mindata.weight[0].length, mindata.weight[1].length);
                 var minstart = (mindata.time + 1 - (mlen % 60) + 60) % 60;
                 var min;
+                var minweights = [mindata.weight[0].slice(), mindata.weight[1].slice()];
+                var now = Date.now();
+
+                events.forEach(function (e) {
+                    var n = minweights[e.plant].length;
+                    var p = n - 1 - Math.floor((now - Date.parse(e.time)) / 60000);
+                    if (p < 0 || p >= n)
+                        return;
+                    minchart.options.verticalLine.push({
+                        index: p + mlen - n,
+                        style: evcol[e.plant],
+                        text: e.kind + ' ' + (e.plant + 1)
+                    });
+                    if (continuous) {
+                        for (j = 0; j < p; ++j)
+                            minweights[e.plant][j] += e.delta;
+                    }
+                });
+
                 for (i = 0; i < mlen; ++i) {
                     min = (minstart + i) % 60;
                     minchart.data.labels.push(min);
                     // minchart.data.datasets[0].data.push(mindata.moisture[i]);
                     // 4052 is weight value with no load
-                    minchart.data.datasets[0].data.push(mindata.weight[0][i]);
-                    minchart.data.datasets[1].data.push(mindata.weight[1][i]);
+                    minchart.data.datasets[0].data.push(minweights[0][i]);
+                    minchart.data.datasets[1].data.push(minweights[1][i]);
                     minchart.data.datasets[2].data.push(mindata.temperature[i] / 100);
                     minchart.data.datasets[3].data.push(mindata.humidity[i] / 100);
+                    minchart.data.datasets[4].data.push(levelAt(mindata, 0, i, mlen));
+                    minchart.data.datasets[5].data.push(levelAt(mindata, 1, i, mlen));
                 }
 
                 minchart.update();
@@ -399,4 +498,38 @@ window.onload = function () {
         xhttp.send();
     }
     getData();
+
+    function getDecisions() {
+        var xhttp = new XMLHttpRequest();
+        xhttp.onreadystatechange = function () {
+            if (this.readyState == 4 && this.status == 200) {
+                var tbody = document.querySelector("#decisions tbody");
+                JSON.parse(xhttp.responseText).forEach(function (d) {
+                    var row = tbody.insertRow();
+                    [
+                        new Date(d.time).toLocaleString(),
+                        d.plant + 1,
+                        d.strategy || "threshold",
+                        d.weight,
+                        d.target,
+                        d.dryout,
+                        d.scale,
+                        d.offset,
+                        d.lastw / 1000,
+                        d.durw,
+                        d.branch,
+                        d.delta,
+                        d.computed / 1000,
+                        d.clamped / 1000,
+                        d.actual === undefined ? "" : d.actual / 1000
+                    ].forEach(function (v) {
+                        row.insertCell().textContent = v;
+                    });
+                });
+            }
+        };
+        xhttp.open("GET", "/decisions?days=7", true);
+        xhttp.send();
+    }
+    getDecisions();
 };
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
@@ -47,6 +46,7 @@ func NewWuc(c i2c.Connector) (*Wuc, error) {
 func (w *Wuc) ReadWeights() (m1 int, m2 int, err error) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	defer func(start time.Time) { observeI2C(cmdGetWeight, start, err) }(time.Now())
 
 	if err = w.connection.WriteByte(consCmd(cmdGetWeight, 0)); err != nil {
 		return
@@ -94,28 +94,36 @@ func (w *Wuc) ReadWeights() (m1 int, m2 int, err error) {
 	return
 }
 
+const (
+	// wateringUnit is the resolution of the watering time in ms
+	wateringUnit = 250
+	// maxWateringTime is the longest watering time the command encodes
+	maxWateringTime = 255 * wateringUnit
+)
+
 // DoWatering sends command for watering.
 func (w *Wuc) DoWatering(index, ms int) int {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	u := (ms + 125) / 250
+	u := (ms + wateringUnit/2) / wateringUnit
 	if u < 0 || u > 255 {
-		log.Printf("watering time out of range: %v(%v)", u, ms)
+		plantLogger("wuc", index).Error("watering time out of range", "units", u, "ms", ms)
 		return 0
 	}
 
-	log.Printf("watering %v ms", u*250)
+	plantLogger("wuc", index).Info("watering", "ms", u*250)
 	cmd := []byte{consCmd(cmdWatering, index), byte(u)}
 
+	start := time.Now()
 	n, err := w.connection.Write(cmd)
-	if err != nil {
-		log.Printf("failed to send watering command: %v", err)
-		return 0
+	if err == nil && n < len(cmd) {
+		err = fmt.Errorf("could not send complete watering command: %v/%v", n, len(cmd))
 	}
+	observeI2C(cmdWatering, start, err)
 
-	if n < len(cmd) {
-		log.Printf("could not send complete watering command: %v/%v", n, len(cmd))
+	if err != nil {
+		plantLogger("wuc", index).Error("failed to send watering command", "err", err)
 		return 0
 	}
 
@@ -125,23 +133,25 @@ func (w *Wuc) DoWatering(index, ms int) int {
 	r, err := w.connection.ReadByte()
 
 	if err != nil {
-		log.Printf("failed to read watering time: %v", err)
+		countI2CError(cmdWatering)
+		plantLogger("wuc", index).Error("failed to read watering time", "err", err)
 		return 0
 	}
 
 	if int(r) != u {
-		log.Printf("watered %v ms", int(r)*250)
+		plantLogger("wuc", index).Warn("watering time differs", "ms", int(r)*250)
 	}
 
 	return int(r) * 250
 }
 
 // ReadLastWatering queries duration of last watering and returns time in ms.
-func (w *Wuc) ReadLastWatering(index int) (int, error) {
+func (w *Wuc) ReadLastWatering(index int) (ms int, err error) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	defer func(start time.Time) { observeI2C(cmdGetLastWatering, start, err) }(time.Now())
 
-	if err := w.connection.WriteByte(consCmd(cmdGetLastWatering, index)); err != nil {
+	if err = w.connection.WriteByte(consCmd(cmdGetLastWatering, index)); err != nil {
 		return 0, err
 	}
 
@@ -158,11 +168,12 @@ func (w *Wuc) ReadLastWatering(index int) (int, error) {
 }
 
 // ReadWateringLimit sends command to measure water Limit and returns result.
-func (w *Wuc) ReadWateringLimit(index int) (int, error) {
+func (w *Wuc) ReadWateringLimit(index int) (limit int, err error) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	defer func(start time.Time) { observeI2C(cmdGetWaterLimit, start, err) }(time.Now())
 
-	if err := w.connection.WriteByte(consCmd(cmdGetWaterLimit, index)); err != nil {
+	if err = w.connection.WriteByte(consCmd(cmdGetWaterLimit, index)); err != nil {
 		return 0, err
 	}
 
@@ -179,15 +190,16 @@ func (w *Wuc) ReadWateringLimit(index int) (int, error) {
 }
 
 // Echo sends echo command with data of given buffer and returns result.
-func (w *Wuc) Echo(buf []byte) ([]byte, error) {
+func (w *Wuc) Echo(buf []byte) (res []byte, err error) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	defer func(start time.Time) { observeI2C(cmdEcho, start, err) }(time.Now())
 
 	b := make([]byte, len(buf)+1)
 	b[0] = consCmd(cmdEcho, 0)
 	copy(b[1:], buf)
 
-	if _, err := w.connection.Write(b); err != nil {
+	if _, err = w.connection.Write(b); err != nil {
 		return nil, err
 	}
 